@@ -3,21 +3,29 @@ package main
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 	"go.uber.org/zap/zapcore"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	certificatesv1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/shijunLee/docker-secret-tools/pkg/config"
 	"github.com/shijunLee/docker-secret-tools/pkg/controller"
 	"github.com/shijunLee/docker-secret-tools/pkg/log"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
+	"github.com/shijunLee/docker-secret-tools/pkg/secretcache"
 	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 	"github.com/shijunLee/docker-secret-tools/pkg/webhook"
 )
@@ -45,29 +53,90 @@ func main() {
 	log.InitLog(logOptions, logFile)
 	ctrl.SetLogger(log.Logger)
 	setupLog := ctrl.Log.WithName("setup")
+	if err = config.GlobalConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid config")
+		os.Exit(1)
+	}
 	runtimeScheme := runtime.NewScheme()
 	utilruntime.Must(clientgoscheme.AddToScheme(runtimeScheme))
 	utilruntime.Must(certificatesv1.AddToScheme(runtimeScheme))
+	// the manager wait the webhook server drain the in-flight admission requests before exit
+	gracefulShutdownTimeout := config.GlobalConfig.ShutdownDelay + config.GlobalConfig.ShutdownGracePeriod + 5*time.Second
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                  runtimeScheme,
-		MetricsBindAddress:      "0",
+		MetricsBindAddress:      config.GlobalConfig.MetricsBindAddress,
+		HealthProbeBindAddress:  config.GlobalConfig.HealthProbeBindAddress,
 		Port:                    9443,
 		LeaderElection:          true,
 		LeaderElectionID:        "7982b436.tools.domain",
 		LeaderElectionNamespace: utils.GetCurrentNameSpace(),
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
+		// only the source secrets and the secrets copied by the tool are cached
+		NewCache: secretcache.New(utils.GetCurrentNameSpace(), utils.ManagedSecretSelector()),
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	if err = (&controller.NamespaceReconciler{
+	if err = mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to add health check")
+		os.Exit(1)
+	}
+	informersChecker := utils.CacheSyncChecker(mgr.GetCache())
+	if err = mgr.AddReadyzCheck("informers", informersChecker); err != nil {
+		setupLog.Error(err, "unable to add informers ready check")
+		os.Exit(1)
+	}
+	sourceSecretsChecker := utils.SourceSecretsChecker(mgr.GetClient(), ctrl.Log.WithName("source-secrets"), config.GlobalConfig.DockerSecretNames)
+	if err = mgr.AddReadyzCheck("source-secrets", sourceSecretsChecker); err != nil {
+		setupLog.Error(err, "unable to add source secrets ready check")
+		os.Exit(1)
+	}
+	reporter := report.NewReporter(ctrl.Log.WithName("report"), mgr.GetEventRecorderFor("docker-secret-tools"))
+	if config.GlobalConfig.DryRun {
+		if err = mgr.Add(reporter); err != nil {
+			setupLog.Error(err, "unable to add dry run reporter")
+			os.Exit(1)
+		}
+		if err = mgr.AddMetricsExtraHandler("/dryrun-report", reporter); err != nil {
+			setupLog.Error(err, "unable to add dry run report handler")
+			os.Exit(1)
+		}
+	}
+	// the webhook request the image secrets here, it never create secrets in the admission request
+	secretRequests := make(chan event.GenericEvent, 1024)
+	var namespaceReconciler = &controller.NamespaceReconciler{
 		Client:            mgr.GetClient(),
 		Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
 		DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-	}).SetupWithManager(mgr); err != nil {
+		DryRun:            config.GlobalConfig.DryRun,
+		Reporter:          reporter,
+	}
+	if err = namespaceReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
 		os.Exit(1)
 	}
+	// the webhook runs on all the replicas, the requests are handled on each replica not only the leader
+	if err = mgr.Add(&controller.SecretRequestRunner{Reconciler: namespaceReconciler, Requests: secretRequests}); err != nil {
+		setupLog.Error(err, "unable to add secret request runner")
+		os.Exit(1)
+	}
+	if config.GlobalConfig.RemediatePullErrors {
+		if err = (&controller.PullErrorReconciler{
+			Client:            mgr.GetClient(),
+			Log:               ctrl.Log.WithName("controllers").WithName("PullErrorReconciler"),
+			Recorder:          mgr.GetEventRecorderFor("docker-secret-tools"),
+			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
+			SecretPriority:    config.GlobalConfig.SecretPriority,
+			Target:            config.GlobalConfig.RemediationTarget,
+			DeletePods:        config.GlobalConfig.RemediationDeletePods,
+			DryRun:            config.GlobalConfig.DryRun,
+			Reporter:          reporter,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PullErrorReconciler")
+			os.Exit(1)
+		}
+	}
 	if port > 0 {
 		config.GlobalConfig.ServerPort = port
 	}
@@ -75,63 +144,71 @@ func main() {
 	switch config.GlobalConfig.SetMethod {
 	case config.SetMethodWebHook:
 		setupLog.Info("start config webhook")
-		go func() {
-			setupLog.Info("start web hook server")
-			var ctx = context.Background()
-			for {
-				if mgr.GetCache().WaitForCacheSync(ctx) {
-					break
-				}
-			}
-			setupLog.Info("waitForCacheSync")
-			server := webhook.NewServer(mgr, config.GlobalConfig)
-			server.Start(ctx)
-		}()
-	case config.SetMethodUpdate:
-		if err = (&controller.WorkloadReconciler{
-			Client:            mgr.GetClient(),
-			Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
-			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-			Object:            &corev1.Pod{},
+		if err = (&controller.WebhookConfigurationReconciler{
+			Client:     mgr.GetClient(),
+			Log:        ctrl.Log.WithName("controllers").WithName("WebhookConfigurationReconciler"),
+			Config:     config.GlobalConfig,
+			RestConfig: mgr.GetConfig(),
 		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
+			setupLog.Error(err, "unable to create controller", "controller", "WebhookConfigurationReconciler")
 			os.Exit(1)
 		}
-		if err = (&controller.WorkloadReconciler{
-			Client:            mgr.GetClient(),
-			Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
-			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-			Object:            &appsv1.Deployment{},
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
+		// the webhook is served on all replicas, the serving certificate is issued by the leader
+		// the admission requests match the images with the index instead of reading the secrets each time
+		registryIndex := utils.NewRegistryIndex(ctrl.Log.WithName("registry-index"), config.GlobalConfig.DockerSecretNames)
+		if err = registryIndex.Watch(context.Background(), mgr.GetCache()); err != nil {
+			setupLog.Error(err, "unable to watch the source secrets")
 			os.Exit(1)
 		}
-		if err = (&controller.WorkloadReconciler{
-			Client:            mgr.GetClient(),
-			Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
-			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-			Object:            &appsv1.StatefulSet{},
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
+		server := webhook.NewServer(mgr, config.GlobalConfig, reporter, secretRequests, registryIndex)
+		// the readiness probe is served on the webhook port, it keeps failing in the shutdown delay after
+		// the manager closed the health probe port
+		server.AddReadyzCheck("informers", informersChecker)
+		server.AddReadyzCheck("source-secrets", sourceSecretsChecker)
+		if err = mgr.Add(server); err != nil {
+			setupLog.Error(err, "unable to add webhook server")
 			os.Exit(1)
 		}
-		if err = (&controller.WorkloadReconciler{
-			Client:            mgr.GetClient(),
-			Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
-			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-			Object:            &appsv1.ReplicaSet{},
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
+		if err = mgr.AddReadyzCheck("certificate", server.CertificateChecker); err != nil {
+			setupLog.Error(err, "unable to add certificate ready check")
 			os.Exit(1)
 		}
-		if err = (&controller.WorkloadReconciler{
-			Client:            mgr.GetClient(),
-			Log:               ctrl.Log.WithName("controllers").WithName("NamespaceReconciler"),
-			DockerSecretNames: config.GlobalConfig.DockerSecretNames,
-			Object:            &appsv1.DaemonSet{},
-		}).SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "NamespaceReconciler")
-			os.Exit(1)
+		if config.GlobalConfig.AutoTLS && !webhook.CertManagerEnabled(config.GlobalConfig) {
+			if err = mgr.Add(webhook.NewCertificateRotator(mgr, config.GlobalConfig)); err != nil {
+				setupLog.Error(err, "unable to add certificate rotator")
+				os.Exit(1)
+			}
+		}
+	case config.SetMethodUpdate:
+		var workloads = []client.Object{
+			&corev1.Pod{},
+			&appsv1.Deployment{},
+			&appsv1.StatefulSet{},
+			&appsv1.ReplicaSet{},
+			&appsv1.DaemonSet{},
+		}
+		// batch/v1beta1 is removed since kubernetes 1.25, the manager can not start with the watch of a kind not served
+		var cronJobKind = schema.GroupKind{Group: batchv1beta1.GroupName, Kind: "CronJob"}
+		if _, err = mgr.GetRESTMapper().RESTMapping(cronJobKind, batchv1beta1.SchemeGroupVersion.Version); err == nil {
+			workloads = append(workloads, &batchv1beta1.CronJob{})
+		} else {
+			setupLog.Info("batch/v1beta1 CronJob not served, the CronJobs are not watched", "Reason", err.Error())
+		}
+		for _, object := range workloads {
+			if err = (&controller.WorkloadReconciler{
+				Client:            mgr.GetClient(),
+				Log:               ctrl.Log.WithName("controllers").WithName("WorkloadReconciler"),
+				Recorder:          mgr.GetEventRecorderFor("docker-secret-tools"),
+				DockerSecretNames: config.GlobalConfig.DockerSecretNames,
+				SecretPriority:    config.GlobalConfig.SecretPriority,
+				NotManagerOwners:  config.GlobalConfig.NotManagerOwners,
+				Object:            object,
+				DryRun:            config.GlobalConfig.DryRun,
+				Reporter:          reporter,
+			}).SetupWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create controller", "controller", "WorkloadReconciler")
+				os.Exit(1)
+			}
 		}
 	}
 	stopSignalHandler := ctrl.SetupSignalHandler()
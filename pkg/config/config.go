@@ -5,9 +5,12 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type SetMethod string
@@ -17,6 +20,24 @@ var (
 	SetMethodUpdate  SetMethod = "Update"
 )
 
+type RemediationTarget string
+
+var (
+	RemediationTargetWorkload       RemediationTarget = "Workload"
+	RemediationTargetServiceAccount RemediationTarget = "ServiceAccount"
+)
+
+type AutoTLSMode string
+
+var (
+	// AutoTLSModeCSR the serving certificate is signed by the kubernetes CSR signer
+	AutoTLSModeCSR AutoTLSMode = "CSR"
+	// AutoTLSModeSelfSignedCA the serving certificate is signed by a self signed CA kept in cluster
+	AutoTLSModeSelfSignedCA AutoTLSMode = "SelfSignedCA"
+	// AutoTLSModeCertManager the serving certificate is issued by cert-manager and the CA is injected by cert-manager
+	AutoTLSModeCertManager AutoTLSMode = "CertManager"
+)
+
 type Config struct {
 	WatchNamespaces   []string  `json:"watchNamespaces" mapstructure:"watchNamespaces"`
 	DockerSecretNames []string  `json:"dockerSecretNames" mapstructure:"dockerSecretNames"`
@@ -28,14 +49,98 @@ type Config struct {
 	CertFile          string    `json:"certFile" mapstructure:"certFile"`
 	PrivateKeyFile    string    `json:"privateKeyFile" mapstructure:"privateKeyFile"`
 	RootCA            string    `json:"rootCA" mapstructure:"rootCA"`
+	// RemediatePullErrors watch the pods can not pull image for authentication and add the missing secret
+	RemediatePullErrors bool `json:"remediatePullErrors" mapstructure:"remediatePullErrors"`
+	// RemediationTarget the object to add the missing secret, Workload or ServiceAccount
+	RemediationTarget RemediationTarget `json:"remediationTarget" mapstructure:"remediationTarget"`
+	// RemediationDeletePods delete the stuck pod after remediation so it is recreated with the secret
+	RemediationDeletePods bool `json:"remediationDeletePods" mapstructure:"remediationDeletePods"`
+	// DryRun compute the changes without apply them, the changes are reported in logs, events and the summary report
+	DryRun bool `json:"dryRun" mapstructure:"dryRun"`
+	// WebhookFailurePolicy the failurePolicy of the mutating webhook, Ignore or Fail
+	WebhookFailurePolicy admissionregistrationv1.FailurePolicyType `json:"webhookFailurePolicy" mapstructure:"webhookFailurePolicy"`
+	// WebhookTimeoutSeconds the timeoutSeconds of the mutating webhook, between 1 and 30
+	WebhookTimeoutSeconds int32 `json:"webhookTimeoutSeconds" mapstructure:"webhookTimeoutSeconds"`
+	// WebhookReinvocationPolicy the reinvocationPolicy of the mutating webhook, Never or IfNeeded
+	WebhookReinvocationPolicy admissionregistrationv1.ReinvocationPolicyType `json:"webhookReinvocationPolicy" mapstructure:"webhookReinvocationPolicy"`
+	// WebhookMatchPolicy the matchPolicy of the mutating webhook, Exact or Equivalent
+	WebhookMatchPolicy admissionregistrationv1.MatchPolicyType `json:"webhookMatchPolicy" mapstructure:"webhookMatchPolicy"`
+	// WebhookNamespaceSelector the namespaces go through the mutating webhook, the opt-out labels are always added
+	WebhookNamespaceSelector *metav1.LabelSelector `json:"webhookNamespaceSelector" mapstructure:"webhookNamespaceSelector"`
+	// WebhookObjectSelector the objects go through the mutating webhook, the opt-out labels are always added
+	WebhookObjectSelector *metav1.LabelSelector `json:"webhookObjectSelector" mapstructure:"webhookObjectSelector"`
+	// WebhookOptIn only the namespaces and objects labeled secret-tools.io/inject: enabled go through the mutating webhook
+	WebhookOptIn bool `json:"webhookOptIn" mapstructure:"webhookOptIn"`
+	// CertRenewBefore renew the auto TLS serving certificate when it expires within the duration
+	CertRenewBefore time.Duration `json:"certRenewBefore" mapstructure:"certRenewBefore"`
+	// AutoTLSMode how the auto TLS serving certificate is signed, CSR, SelfSignedCA or CertManager
+	AutoTLSMode AutoTLSMode `json:"autoTLSMode" mapstructure:"autoTLSMode"`
+	// CertManagerCertificate the cert-manager Certificate of the serving certificate, default the service name
+	CertManagerCertificate string `json:"certManagerCertificate" mapstructure:"certManagerCertificate"`
+	// CertManagerIssuerName the issuer to create the Certificate when it not exist
+	CertManagerIssuerName string `json:"certManagerIssuerName" mapstructure:"certManagerIssuerName"`
+	// CertManagerIssuerKind the kind of the issuer, Issuer or ClusterIssuer
+	CertManagerIssuerKind string `json:"certManagerIssuerKind" mapstructure:"certManagerIssuerKind"`
+	// ShutdownDelay keep serving with the readiness failed before draining, so the endpoints remove the pod
+	ShutdownDelay time.Duration `json:"shutdownDelay" mapstructure:"shutdownDelay"`
+	// ShutdownGracePeriod wait the in-flight admission requests finish when the webhook server shutdown
+	ShutdownGracePeriod time.Duration `json:"shutdownGracePeriod" mapstructure:"shutdownGracePeriod"`
+	// MetricsBindAddress the address the prometheus metrics served on, "0" disable the metrics
+	MetricsBindAddress string `json:"metricsBindAddress" mapstructure:"metricsBindAddress"`
+	// HealthProbeBindAddress the plain http address the /healthz and /readyz probes served on
+	HealthProbeBindAddress string `json:"healthProbeBindAddress" mapstructure:"healthProbeBindAddress"`
+	// SecretPriority the docker secret names in the order the imagePullSecrets are injected, the kubelet try
+	// the credentials of the same registry in this order. The secrets not listed follow in the dockerSecretNames order
+	SecretPriority []string `json:"secretPriority" mapstructure:"secretPriority"`
 }
 
 var GlobalConfig = &Config{}
 
+//Validate check the mutating webhook options are accepted by the api server, the empty options use the defaults
+func (c *Config) Validate() error {
+	if c.WebhookTimeoutSeconds != 0 && (c.WebhookTimeoutSeconds < 1 || c.WebhookTimeoutSeconds > 30) {
+		return fmt.Errorf("webhookTimeoutSeconds %d must be between 1 and 30", c.WebhookTimeoutSeconds)
+	}
+	if err := validateEnum("webhookFailurePolicy", string(c.WebhookFailurePolicy),
+		string(admissionregistrationv1.Ignore), string(admissionregistrationv1.Fail)); err != nil {
+		return err
+	}
+	if err := validateEnum("webhookMatchPolicy", string(c.WebhookMatchPolicy),
+		string(admissionregistrationv1.Exact), string(admissionregistrationv1.Equivalent)); err != nil {
+		return err
+	}
+	return validateEnum("webhookReinvocationPolicy", string(c.WebhookReinvocationPolicy),
+		string(admissionregistrationv1.NeverReinvocationPolicy), string(admissionregistrationv1.IfNeededReinvocationPolicy))
+}
+
+// validateEnum check the option value is empty or one of the allowed values
+func validateEnum(name string, value string, allowed ...string) error {
+	if value == "" {
+		return nil
+	}
+	for _, item := range allowed {
+		if value == item {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q must be one of %s", name, value, strings.Join(allowed, ", "))
+}
+
 func InitConfig(cfgFile string) {
 	viper.SetDefault("setMethod", "WebHook")
 	viper.SetDefault("serverPort", 8888)
 	viper.SetDefault("autoTLS", true)
+	viper.SetDefault("remediationTarget", "Workload")
+	viper.SetDefault("webhookFailurePolicy", "Ignore")
+	viper.SetDefault("webhookTimeoutSeconds", 10)
+	viper.SetDefault("webhookReinvocationPolicy", "Never")
+	viper.SetDefault("webhookMatchPolicy", "Equivalent")
+	viper.SetDefault("certRenewBefore", "720h")
+	viper.SetDefault("autoTLSMode", "CSR")
+	viper.SetDefault("shutdownDelay", "5s")
+	viper.SetDefault("shutdownGracePeriod", "20s")
+	viper.SetDefault("metricsBindAddress", ":8080")
+	viper.SetDefault("healthProbeBindAddress", ":8081")
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
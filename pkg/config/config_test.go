@@ -15,3 +15,27 @@ func Test_InitConfig(t *testing.T) {
 	}
 	fmt.Println(string(data))
 }
+
+func TestConfig_Validate(t *testing.T) {
+	var tests = []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "defaults", config: Config{}},
+		{name: "valid", config: Config{WebhookTimeoutSeconds: 30, WebhookFailurePolicy: "Fail",
+			WebhookMatchPolicy: "Exact", WebhookReinvocationPolicy: "IfNeeded"}},
+		{name: "timeout too small", config: Config{WebhookTimeoutSeconds: -1}, wantErr: true},
+		{name: "timeout too large", config: Config{WebhookTimeoutSeconds: 31}, wantErr: true},
+		{name: "failure policy", config: Config{WebhookFailurePolicy: "ignore"}, wantErr: true},
+		{name: "match policy", config: Config{WebhookMatchPolicy: "Equal"}, wantErr: true},
+		{name: "reinvocation policy", config: Config{WebhookReinvocationPolicy: "Always"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,16 +2,21 @@ package controller
 
 import (
 	"context"
+	"reflect"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
 	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 )
 
@@ -19,9 +24,13 @@ type NamespaceReconciler struct {
 	client.Client
 	Log               logr.Logger
 	DockerSecretNames []string
+	// DryRun only report the changes with Reporter
+	DryRun   bool
+	Reporter *report.Reporter
 }
 
-//Reconcile auto create secret to new namespace
+//Reconcile auto create secret to new namespace, the copies created before the managed label was added
+// are labeled so they are read from the managed secrets cache
 func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	var secrets = utils.GetDockerSecrets(ctx, r.Client, r.Log, r.DockerSecretNames)
 	for _, item := range secrets {
@@ -33,24 +42,57 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: item.Name}, imagePullSecret)
 		if err != nil {
 			if k8serrors.IsNotFound(err) {
-				var secret = *item
-
-				secret.Namespace = namespace
-				secret.ObjectMeta.ResourceVersion = ""
-				err := r.Client.Create(ctx, &secret)
-				if err != nil {
+				var secret = utils.PropagatedSecret(*item, namespace)
+				if r.DryRun {
+					r.Reporter.Record(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, report.Action{
+						Source: "NamespaceReconciler", Action: report.ActionCreateSecret, Kind: "Secret",
+						Namespace: namespace, Name: secret.Name})
+					continue
+				}
+				err := r.Client.Create(ctx, secret)
+				if err != nil && !k8serrors.IsAlreadyExists(err) {
+					metrics.PropagationFailures.WithLabelValues(namespace).Inc()
 					r.Log.Error(err, "create secret to namespace error", "SecretName", secret.Name, "Namespace", req.Namespace)
 					return ctrl.Result{}, err
 				}
 			}
+		} else if namespace != utils.GetCurrentNameSpace() && legacyCopy(imagePullSecret, item) {
+			if err = r.labelManaged(ctx, imagePullSecret); err != nil {
+				return ctrl.Result{}, err
+			}
 		}
 	}
 	return ctrl.Result{}, nil
 }
 
+// legacyCopy check the secret is the copy of the source secret created without the managed label, the
+// secret of the user with the same name is not the copy
+func legacyCopy(secret *corev1.Secret, source *corev1.Secret) bool {
+	return secret.Labels[utils.ManagedSecretLabel] != "true" && secret.Type == source.Type &&
+		reflect.DeepEqual(secret.Data, source.Data)
+}
+
+// labelManaged add the managed label to the copied secret
+func (r *NamespaceReconciler) labelManaged(ctx context.Context, secret *corev1.Secret) error {
+	if r.DryRun {
+		r.Reporter.Record(nil, report.Action{Source: "NamespaceReconciler", Action: report.ActionLabelSecret,
+			Kind: "Secret", Namespace: secret.Namespace, Name: secret.Name})
+		return nil
+	}
+	var original = secret.DeepCopy()
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[utils.ManagedSecretLabel] = "true"
+	err := r.Client.Patch(ctx, secret, client.MergeFrom(original))
+	if err != nil {
+		r.Log.Error(err, "label copied secret error", "SecretName", secret.Name, "Namespace", secret.Namespace)
+	}
+	return client.IgnoreNotFound(err)
+}
+
 func (w *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Namespace{}).WithEventFilter(predicate.Funcs{
+	return ctrl.NewControllerManagedBy(mgr).For(&corev1.Namespace{}).WithEventFilter(predicate.Funcs{
 		CreateFunc: func(event event.CreateEvent) bool {
 			return true
 		},
@@ -62,3 +104,53 @@ func (w *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		},
 	}).Complete(w)
 }
+
+//SecretRequestRunner create the secrets in the namespaces the admission webhook requested. The webhook
+// serves on all the replicas and send the requests to the local channel, so the runner runs on all the
+// replicas instead of the leader elected namespace controller
+type SecretRequestRunner struct {
+	Reconciler *NamespaceReconciler
+	// Requests the namespaces which the admission webhook need secrets in, the webhook must be
+	// side effect free so the secrets are created here asynchronously
+	Requests <-chan event.GenericEvent
+}
+
+//NeedLeaderElection the requests of each replica are handled by itself
+func (r *SecretRequestRunner) NeedLeaderElection() bool {
+	return false
+}
+
+//Start create the secrets for the requests until the context done, the failed requests are retried with back off
+func (r *SecretRequestRunner) Start(ctx context.Context) error {
+	var queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "secretrequests")
+	go func() {
+		defer queue.ShutDown()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case item := <-r.Requests:
+				queue.Add(item.Object.GetName())
+			}
+		}
+	}()
+	for r.processNext(ctx, queue) {
+	}
+	return nil
+}
+
+func (r *SecretRequestRunner) processNext(ctx context.Context, queue workqueue.RateLimitingInterface) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Name: item.(string)}}
+	if _, err := r.Reconciler.Reconcile(ctx, req); err != nil {
+		r.Reconciler.Log.Error(err, "create requested secrets error", "Namespace", req.Name)
+		queue.AddRateLimited(item)
+		return true
+	}
+	queue.Forget(item)
+	return true
+}
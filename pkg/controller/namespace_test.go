@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+func Test_SecretRequestRunner(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret).Build()
+	var requests = make(chan event.GenericEvent, 1)
+	var runner = &SecretRequestRunner{
+		Reconciler: &NamespaceReconciler{Client: fakeClient, Log: zap.New(), DockerSecretNames: []string{"tpaas-itg"}},
+		Requests:   requests,
+	}
+	if runner.NeedLeaderElection() {
+		t.Fatal("expect the runner run on all the replicas")
+	}
+	var ctx, cancel = context.WithCancel(context.TODO())
+	var done = make(chan error)
+	go func() {
+		done <- runner.Start(ctx)
+	}()
+	requests <- event.GenericEvent{Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app"}}}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		err := fakeClient.Get(ctx, types.NamespacedName{Namespace: "app", Name: "tpaas-itg"}, &corev1.Secret{})
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatal("expect the requested secret created")
+	}
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_NamespaceReconcileLabelLegacyCopy(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	// the copy created before the managed label and the secret of the user with the same name
+	var legacy = sourceSecret.DeepCopy()
+	legacy.Namespace = "app"
+	var userSecret = sourceSecret.DeepCopy()
+	userSecret.Namespace = "user"
+	userSecret.Data = map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)}
+	var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, legacy, userSecret).Build()
+	var reconciler = &NamespaceReconciler{Client: fakeClient, Log: zap.New(), DockerSecretNames: []string{"tpaas-itg"}}
+	for _, namespace := range []string{"tool-test", "app", "user"} {
+		if _, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: namespace}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for namespace, expect := range map[string]string{"tool-test": "", "app": "true", "user": ""} {
+		var secret = &corev1.Secret{}
+		if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: "tpaas-itg"}, secret); err != nil {
+			t.Fatal(err)
+		}
+		if secret.Labels[utils.ManagedSecretLabel] != expect {
+			t.Fatalf("unexpected managed label of %s: %v", namespace, secret.Labels)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// maxOwnerDepth stop walking the owner chain when the owner references is a loop
+const maxOwnerDepth = 10
+
+// toUnstructured convert the typed object to unstructured object with the group version kind set
+func toUnstructured(object client.Object, scheme *runtime.Scheme) (*unstructured.Unstructured, error) {
+	gvk, err := apiutil.GVKForObject(object, scheme)
+	if err != nil {
+		return nil, err
+	}
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return nil, err
+	}
+	var result = &unstructured.Unstructured{Object: data}
+	result.SetGroupVersionKind(gvk)
+	return result, nil
+}
+
+// getObject get the object as unstructured object. The kinds in the scheme are read as typed objects
+// from the cache, the controller-runtime client read the unstructured objects from the api server
+func getObject(ctx context.Context, c client.Client, gvk schema.GroupVersionKind, key types.NamespacedName) (*unstructured.Unstructured, error) {
+	if typed, err := c.Scheme().New(gvk); err == nil {
+		if object, ok := typed.(client.Object); ok {
+			if err = c.Get(ctx, key, object); err != nil {
+				return nil, err
+			}
+			return toUnstructured(object, c.Scheme())
+		}
+	}
+	var object = &unstructured.Unstructured{}
+	object.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, key, object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// resolveTopOwner walk up the controller owner references and return the top level object,
+// the object itself is returned when it has no controller owner
+func resolveTopOwner(ctx context.Context, c client.Client, object *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	chain, err := ownerChain(ctx, c, object)
+	if err != nil {
+		return nil, err
+	}
+	return chain[len(chain)-1], nil
+}
+
+// ownerChain walk up the controller owner references, the result start with the object and end with
+// the top level owner. The walk stop at the owner which is not found, such as the owner is deleting, and
+// the owner can not be read, such as the custom resources the tool has no rights on or the kind not served
+func ownerChain(ctx context.Context, c client.Client, object *unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var result = []*unstructured.Unstructured{object}
+	var current = object
+	for i := 0; i < maxOwnerDepth; i++ {
+		ownerReference := metav1.GetControllerOf(current)
+		if ownerReference == nil {
+			return result, nil
+		}
+		gv, err := schema.ParseGroupVersion(ownerReference.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		owner, err := getObject(ctx, c, gv.WithKind(ownerReference.Kind),
+			types.NamespacedName{Namespace: current.GetNamespace(), Name: ownerReference.Name})
+		if err != nil {
+			if k8serrors.IsNotFound(err) || k8serrors.IsForbidden(err) || meta.IsNoMatchError(err) {
+				return result, nil
+			}
+			return nil, err
+		}
+		result = append(result, owner)
+		current = owner
+	}
+	return result, nil
+}
+
+// ownerMatch check the owner matches the not manager owner config, the config can be
+// the apiVersion such as apps/v1, the kind such as Job or both such as batch/v1/Job
+func ownerMatch(notManagerOwner, apiVersion, kind string) bool {
+	return notManagerOwner == apiVersion || notManagerOwner == kind || notManagerOwner == apiVersion+"/"+kind
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+// podTemplatePath get the pod template path in the workload object, the pod itself is the template.
+// ok is false when the kind pod template is unknown
+func podTemplatePath(kind string) (path []string, ok bool) {
+	switch kind {
+	case "Pod":
+		return nil, true
+	case "Deployment", "DaemonSet", "StatefulSet", "ReplicaSet", "ReplicationController", "Job":
+		return []string{"spec", "template"}, true
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template"}, true
+	default:
+		return nil, false
+	}
+}
+
+// templateMutable the pod template of pods and jobs can not be changed after created
+func templateMutable(kind string) bool {
+	if kind == "Pod" || kind == "Job" {
+		return false
+	}
+	_, ok := podTemplatePath(kind)
+	return ok
+}
+
+// syncPodTemplateSecrets add secrets to the object pod template imagePullSecrets and remove the
+// secrets added by the tool before which not in required, changed is false when nothing to patch.
+// The object is not patched in dry run, result is the imagePullSecrets the object would have
+func syncPodTemplateSecrets(ctx context.Context, c client.Client, object *unstructured.Unstructured,
+	add []string, required []string, dryRun bool) (result []string, changed bool, err error) {
+	templatePath, _ := podTemplatePath(object.GetKind())
+	var imagePullSecretsPath = append(append([]string{}, templatePath...), "spec", "imagePullSecrets")
+	var annotationsPath = append(append([]string{}, templatePath...), "metadata", "annotations")
+	imagePullSecrets, _, _ := unstructured.NestedSlice(object.Object, imagePullSecretsPath...)
+	var current []string
+	for _, item := range imagePullSecrets {
+		if secretRef, ok := item.(map[string]interface{}); ok {
+			name, _ := secretRef["name"].(string)
+			current = append(current, name)
+		}
+	}
+	annotations, _, _ := unstructured.NestedStringMap(object.Object, annotationsPath...)
+	managed := utils.ParseManagedPullSecrets(annotations)
+	result, resultManaged := utils.MergeImagePullSecrets(current, managed, add, required)
+	// the managed annotation is written sorted, resultManaged is in the imagePullSecrets order
+	if reflect.DeepEqual(result, current) && reflect.DeepEqual(sortedCopy(resultManaged), sortedCopy(managed)) {
+		return result, false, nil
+	}
+	if dryRun {
+		return result, true, nil
+	}
+
+	var original = object.DeepCopy()
+	if len(result) > 0 {
+		var secretListKV []interface{}
+		for _, secret := range result {
+			secretListKV = append(secretListKV, map[string]interface{}{"name": secret})
+		}
+		err = unstructured.SetNestedSlice(object.Object, secretListKV, imagePullSecretsPath...)
+	} else {
+		unstructured.RemoveNestedField(object.Object, imagePullSecretsPath...)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	annotations = utils.SetManagedPullSecrets(annotations, resultManaged)
+	if len(annotations) > 0 {
+		err = unstructured.SetNestedStringMap(object.Object, annotations, annotationsPath...)
+	} else {
+		unstructured.RemoveNestedField(object.Object, annotationsPath...)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	err = c.Patch(ctx, object, client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{}))
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// sortedCopy the sorted copy of the names
+func sortedCopy(names []string) []string {
+	var result = append([]string{}, names...)
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,337 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+const (
+	reasonErrImagePull     = "ErrImagePull"
+	reasonImagePullBackOff = "ImagePullBackOff"
+)
+
+// authErrorMessages the image pull error messages which mean the registry need credential, the status codes
+// are matched with the status text so the digits in the image tags and digests not match
+var authErrorMessages = []string{
+	"unauthorized",
+	"authentication required",
+	"no basic auth credentials",
+	"access denied",
+	"authorization failed",
+	"401 unauthorized",
+	"403 forbidden",
+}
+
+//PullErrorReconciler add the missing pull secret for the pods which can not pull image for authentication
+type PullErrorReconciler struct {
+	client.Client
+	Log               logr.Logger
+	Recorder          record.EventRecorder
+	DockerSecretNames []string
+	Target            config.RemediationTarget
+	DeletePods        bool
+	// SecretPriority the order of the added secrets before the dockerSecretNames order
+	SecretPriority []string
+	// DryRun only report the changes with Reporter
+	DryRun   bool
+	Reporter *report.Reporter
+	// authFailures the images each pod failed to pull for authentication, the back off status not contains
+	// the pull error so the back off images are only handled after an authentication ErrImagePull.
+	// The failures are only kept in memory, after a restart or a leader change the pods already in
+	// ImagePullBackOff are handled when the kubelet retry the pull and report the next ErrImagePull,
+	// which is at most the five minutes back off of the kubelet later
+	lock         sync.Mutex
+	authFailures map[types.NamespacedName][]string
+}
+
+//Reconcile find the credential for the failed images and fix the pod owner workload or service account
+func (r *PullErrorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var pod = &corev1.Pod{}
+	err := r.Client.Get(ctx, req.NamespacedName, pod)
+	if k8serrors.IsNotFound(err) {
+		r.forget(req.NamespacedName)
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	failedImages := r.observePullErrors(pod)
+	if len(failedImages) == 0 {
+		return ctrl.Result{}, nil
+	}
+	podObject, err := toUnstructured(pod, r.Client.Scheme())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	owner, err := resolveTopOwner(ctx, r.Client, podObject)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// the injection annotations of the top owner are honored the same as the webhook and WorkloadReconciler
+	var injection = utils.ParseWorkloadInjection(owner)
+	if injection.Skip {
+		r.Log.Info("skip the pull error remediation by annotation", "Pod", req.NamespacedName,
+			"Kind", owner.GetKind(), "Name", owner.GetName())
+		return ctrl.Result{}, nil
+	}
+	var registrySecrets = utils.GetSecretAuthRegistry(ctx, r.Client, r.Log, r.DockerSecretNames)
+	var podSecrets []string
+	for _, item := range pod.Spec.ImagePullSecrets {
+		podSecrets = append(podSecrets, item.Name)
+	}
+	// the secrets already on the pod can not pull the image, it is not a missing credential
+	var missingSecrets []string
+	imageSecrets, _ := injection.Select(registrySecrets, failedImages)
+	for _, item := range utils.OrderSecrets(imageSecrets, utils.SecretOrder(r.SecretPriority, r.DockerSecretNames)) {
+		if !containString(podSecrets, item.Name) && !containString(missingSecrets, item.Name) {
+			if err = r.ensureSecret(ctx, pod.Namespace, item); err != nil {
+				return ctrl.Result{}, err
+			}
+			missingSecrets = append(missingSecrets, item.Name)
+		}
+	}
+	if len(missingSecrets) == 0 {
+		r.Log.Info("no credential found for the failed images", "Pod", req.NamespacedName, "Images", failedImages)
+		return ctrl.Result{}, nil
+	}
+
+	if r.Target == config.RemediationTargetServiceAccount || !templateMutable(owner.GetKind()) {
+		// the pod template of bare pods, jobs and custom resources can not be patched
+		err = r.patchServiceAccount(ctx, pod, missingSecrets)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !r.DryRun {
+			r.Recorder.Eventf(pod, corev1.EventTypeNormal, "PullSecretRemediated",
+				"add image pull secrets %s to service account %s", strings.Join(missingSecrets, ","), serviceAccountName(pod))
+		}
+	} else {
+		var images []string
+		for _, container := range pod.Spec.InitContainers {
+			images = append(images, container.Image)
+		}
+		for _, container := range pod.Spec.Containers {
+			images = append(images, container.Image)
+		}
+		var requiredSecrets []string
+		allSecrets, _ := injection.Select(registrySecrets, images)
+		for _, item := range allSecrets {
+			requiredSecrets = append(requiredSecrets, item.Name)
+		}
+		result, changed, err := syncPodTemplateSecrets(ctx, r.Client, owner, missingSecrets, requiredSecrets, r.DryRun)
+		if err != nil {
+			r.Log.Error(err, "patch owner secret error", "Kind", owner.GetKind(), "Name", owner.GetName(), "Namespace", owner.GetNamespace())
+			return ctrl.Result{}, err
+		}
+		if r.DryRun {
+			if changed {
+				r.Reporter.Record(pod, report.Action{Source: "PullErrorReconciler", Action: report.ActionPatchImagePullSecrets,
+					Kind: owner.GetKind(), Namespace: owner.GetNamespace(), Name: owner.GetName(),
+					Detail: fmt.Sprintf("imagePullSecrets %v", result)})
+			}
+		} else {
+			r.Recorder.Eventf(pod, corev1.EventTypeNormal, "PullSecretRemediated",
+				"add image pull secrets %s to %s %s", strings.Join(missingSecrets, ","), owner.GetKind(), owner.GetName())
+		}
+	}
+
+	// the bare pod will not be recreated after delete
+	if r.DeletePods && owner.GetUID() != pod.GetUID() {
+		if r.DryRun {
+			r.Reporter.Record(pod, report.Action{Source: "PullErrorReconciler", Action: report.ActionDeletePod,
+				Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name})
+			return ctrl.Result{}, nil
+		}
+		err = r.Client.Delete(ctx, pod)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			r.Log.Error(err, "delete pull error pod error", "Pod", req.NamespacedName)
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// ensureSecret copy the docker secret to the namespace when it not exist
+func (r *PullErrorReconciler) ensureSecret(ctx context.Context, namespace string, item corev1.Secret) error {
+	var secret = &corev1.Secret{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: item.Name}, secret)
+	if err == nil || !k8serrors.IsNotFound(err) {
+		return err
+	}
+	if r.DryRun {
+		r.Reporter.Record(nil, report.Action{Source: "PullErrorReconciler", Action: report.ActionCreateSecret,
+			Kind: "Secret", Namespace: namespace, Name: item.Name})
+		return nil
+	}
+	err = r.Client.Create(ctx, utils.PropagatedSecret(item, namespace))
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		metrics.PropagationFailures.WithLabelValues(namespace).Inc()
+		r.Log.Error(err, "create secret error", "SecretName", item.Name, "Namespace", namespace)
+		return err
+	}
+	return nil
+}
+
+// patchServiceAccount add the secrets to the pod service account imagePullSecrets
+func (r *PullErrorReconciler) patchServiceAccount(ctx context.Context, pod *corev1.Pod, secrets []string) error {
+	var serviceAccount = &corev1.ServiceAccount{}
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: serviceAccountName(pod)}, serviceAccount)
+	if err != nil {
+		return err
+	}
+	var original = serviceAccount.DeepCopy()
+	for _, item := range secrets {
+		var found = false
+		for _, secretRef := range serviceAccount.ImagePullSecrets {
+			if secretRef.Name == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, corev1.LocalObjectReference{Name: item})
+		}
+	}
+	if len(serviceAccount.ImagePullSecrets) == len(original.ImagePullSecrets) {
+		return nil
+	}
+	if r.DryRun {
+		r.Reporter.Record(pod, report.Action{Source: "PullErrorReconciler", Action: report.ActionPatchServiceAccount,
+			Kind: "ServiceAccount", Namespace: pod.Namespace, Name: serviceAccount.Name,
+			Detail: fmt.Sprintf("imagePullSecrets %v", secrets)})
+		return nil
+	}
+	err = r.Client.Patch(ctx, serviceAccount, client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{}))
+	if err != nil {
+		r.Log.Error(err, "patch service account secret error", "ServiceAccount", serviceAccount.Name, "Namespace", pod.Namespace)
+	}
+	return err
+}
+
+func (r *PullErrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pullerror").
+		For(&corev1.Pod{}).WithEventFilter(predicate.Funcs{
+		CreateFunc: func(event event.CreateEvent) bool {
+			return r.hasPullError(event.Object)
+		},
+		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+			return r.hasPullError(updateEvent.ObjectNew)
+		},
+		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+			// the failures of the deleted pod are forgotten on reconcile
+			return r.tracked(client.ObjectKeyFromObject(deleteEvent.Object))
+		},
+	}).Complete(r)
+}
+
+func serviceAccountName(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+func (r *PullErrorReconciler) hasPullError(object client.Object) bool {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(authPullErrorImages(pod, r.authFailures[client.ObjectKeyFromObject(pod)])) > 0
+}
+
+// observePullErrors remember the images the pod failed to pull for authentication and get the images
+// the pod can not pull for authentication now
+func (r *PullErrorReconciler) observePullErrors(pod *corev1.Pod) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var key = client.ObjectKeyFromObject(pod)
+	var result = authPullErrorImages(pod, r.authFailures[key])
+	for _, item := range result {
+		if !containString(r.authFailures[key], item) {
+			if r.authFailures == nil {
+				r.authFailures = map[types.NamespacedName][]string{}
+			}
+			r.authFailures[key] = append(r.authFailures[key], item)
+		}
+	}
+	return result
+}
+
+func (r *PullErrorReconciler) tracked(key types.NamespacedName) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.authFailures[key]
+	return ok
+}
+
+func (r *PullErrorReconciler) forget(key types.NamespacedName) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.authFailures, key)
+}
+
+// authPullErrorImages get the images the pod can not pull for authentication. The back off message
+// not contains the pull error, the back off images are returned only when they are in authFailures
+func authPullErrorImages(pod *corev1.Pod, authFailures []string) []string {
+	var result []string
+	var statuses = append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		switch status.State.Waiting.Reason {
+		case reasonErrImagePull:
+			if !isAuthErrorMessage(status.State.Waiting.Message) {
+				continue
+			}
+		case reasonImagePullBackOff:
+			if !containString(authFailures, status.Image) {
+				continue
+			}
+		default:
+			continue
+		}
+		if !containString(result, status.Image) {
+			result = append(result, status.Image)
+		}
+	}
+	return result
+}
+
+func isAuthErrorMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, item := range authErrorMessages {
+		if strings.Contains(message, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func containString(array []string, value string) bool {
+	for _, item := range array {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
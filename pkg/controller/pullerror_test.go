@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+func Test_AuthPullErrorImages(t *testing.T) {
+	var pod = &corev1.Pod{
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Image: "docker.shijunlee.local/library/nginx:latest", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason:  reasonErrImagePull,
+					Message: "rpc error: code = Unknown desc = Error response from daemon: unauthorized: authentication required",
+				}}},
+				{Image: "docker.shijunlee.local/library/busybox:none", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason:  reasonErrImagePull,
+					Message: "rpc error: code = NotFound desc = manifest unknown",
+				}}},
+				{Image: "docker.shijunlee.local/library/busybox:401", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason:  reasonErrImagePull,
+					Message: "rpc error: code = NotFound desc = docker.shijunlee.local/library/busybox:401: not found",
+				}}},
+				{Image: "docker.shijunlee.local/library/redis:latest", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason: reasonImagePullBackOff,
+				}}},
+			},
+		},
+	}
+	// the back off image not failed for authentication before is not handled
+	result := authPullErrorImages(pod, nil)
+	var expect = []string{"docker.shijunlee.local/library/nginx:latest"}
+	if !reflect.DeepEqual(result, expect) {
+		t.Fatalf("unexpected images %v", result)
+	}
+	result = authPullErrorImages(pod, []string{"docker.shijunlee.local/library/redis:latest"})
+	expect = []string{"docker.shijunlee.local/library/nginx:latest", "docker.shijunlee.local/library/redis:latest"}
+	if !reflect.DeepEqual(result, expect) {
+		t.Fatalf("unexpected images %v", result)
+	}
+}
+
+func Test_PullErrorReconcile(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	deployment, replicaSet, pod := newTestPullErrorObjects(nil)
+	var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, deployment, replicaSet, pod).Build()
+	var reconciler = &PullErrorReconciler{
+		Client:            fakeClient,
+		Log:               zap.New(),
+		Recorder:          record.NewFakeRecorder(10),
+		DockerSecretNames: []string{"tpaas-itg"},
+		Target:            config.RemediationTargetWorkload,
+		DeletePods:        true,
+	}
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: pod.Name}}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	var result = &appsv1.Deployment{}
+	if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "nginx"}, result); err != nil {
+		t.Fatal(err)
+	}
+	var expect = []corev1.LocalObjectReference{{Name: "tpaas-itg"}}
+	if !reflect.DeepEqual(result.Spec.Template.Spec.ImagePullSecrets, expect) {
+		t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+	}
+	if err := fakeClient.Get(context.TODO(), req.NamespacedName, &corev1.Pod{}); err == nil {
+		t.Fatal("expect the stuck pod is deleted")
+	}
+}
+
+// newTestPullErrorObjects the pod of a deployment which can not pull the image for authentication, the
+// annotations are set on the deployment
+func newTestPullErrorObjects(annotations map[string]string) (*appsv1.Deployment, *appsv1.ReplicaSet, *corev1.Pod) {
+	var image = "docker.shijunlee.local/library/nginx:latest"
+	var deployment = &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test", UID: "deployment-uid", Annotations: annotations},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: image}}},
+			},
+		},
+	}
+	var replicaSet = &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "test", UID: "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx",
+				UID: "deployment-uid", Controller: pointer.BoolPtr(true)}}},
+	}
+	var pod = &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1-abcde", Namespace: "test", UID: "pod-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-1",
+				UID: "replicaset-uid", Controller: pointer.BoolPtr(true)}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: image}}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Image: image, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reasonErrImagePull,
+					Message: "Error response from daemon: Get https://docker.shijunlee.local/v2/: 401 Unauthorized"}}},
+			},
+		},
+	}
+	return deployment, replicaSet, pod
+}
+
+func Test_PullErrorReconcileAnnotations(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	// the requested secret is not matched by the image registry
+	var extraSecret = newTestSourceSecret("tpaas-extra")
+	extraSecret.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"quay.io":{"auth":"dGVzdDp0ZXN0"}}}`)
+	var tests = []struct {
+		name        string
+		annotations map[string]string
+		expect      []corev1.LocalObjectReference
+	}{
+		{name: "skip", annotations: map[string]string{utils.SkipAnnotation: "true"}},
+		{name: "secrets", annotations: map[string]string{utils.SecretsAnnotation: "tpaas-extra"},
+			expect: []corev1.LocalObjectReference{{Name: "tpaas-itg"}, {Name: "tpaas-extra"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment, replicaSet, pod := newTestPullErrorObjects(tt.annotations)
+			var fakeClient = fake.NewClientBuilder().WithScheme(scheme).
+				WithObjects(newTestSourceSecret("tpaas-itg"), extraSecret.DeepCopy(), deployment, replicaSet, pod).Build()
+			var reconciler = &PullErrorReconciler{
+				Client:            fakeClient,
+				Log:               zap.New(),
+				Recorder:          record.NewFakeRecorder(10),
+				DockerSecretNames: []string{"tpaas-itg", "tpaas-extra"},
+				Target:            config.RemediationTargetWorkload,
+			}
+			var req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: pod.Name}}
+			if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+				t.Fatal(err)
+			}
+			var result = &appsv1.Deployment{}
+			if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "nginx"}, result); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Spec.Template.Spec.ImagePullSecrets, tt.expect) {
+				t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+			}
+		})
+	}
+}
+
+func Test_ObservePullErrors(t *testing.T) {
+	var image = "docker.shijunlee.local/library/nginx:latest"
+	var newPod = func(waiting corev1.ContainerStateWaiting) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Image: image, State: corev1.ContainerState{Waiting: &waiting}},
+			}},
+		}
+	}
+	var reconciler = &PullErrorReconciler{}
+	var backOff = newPod(corev1.ContainerStateWaiting{Reason: reasonImagePullBackOff})
+	if reconciler.hasPullError(backOff) || len(reconciler.observePullErrors(backOff)) != 0 {
+		t.Fatal("expect the back off not handled before an authentication pull error")
+	}
+	reconciler.observePullErrors(newPod(corev1.ContainerStateWaiting{Reason: reasonErrImagePull, Message: "401 Unauthorized"}))
+	if !reconciler.hasPullError(backOff) || !reflect.DeepEqual(reconciler.observePullErrors(backOff), []string{image}) {
+		t.Fatal("expect the back off handled after the authentication pull error")
+	}
+	reconciler.forget(client.ObjectKeyFromObject(backOff))
+	if reconciler.hasPullError(backOff) {
+		t.Fatal("expect the failures of the deleted pod forgotten")
+	}
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+	"github.com/shijunLee/docker-secret-tools/pkg/webhook"
+)
+
+//WebhookConfigurationReconciler keep the MutatingWebhookConfiguration the same as rendered from the config,
+// the configuration is created when missing and the changes made by others are reverted
+type WebhookConfigurationReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Config *config.Config
+	// RestConfig the rest config used to find the kubernetes CA
+	RestConfig *rest.Config
+}
+
+//Reconcile create or update the MutatingWebhookConfiguration to the desired state
+func (r *WebhookConfigurationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if req.Name != webhook.ConfigurationName {
+		return ctrl.Result{}, nil
+	}
+	var certManager = webhook.CertManagerEnabled(r.Config)
+	if certManager {
+		if err := webhook.EnsureCertificate(ctx, r.Client, r.Config); err != nil {
+			r.Log.Error(err, "ensure cert-manager certificate error")
+			return ctrl.Result{}, err
+		}
+	}
+	caBundle, err := webhook.CABundle(ctx, r.Client, r.RestConfig, r.Config)
+	if err != nil {
+		r.Log.Error(err, "get webhook ca bundle error")
+		return ctrl.Result{}, err
+	}
+	desired := webhook.RenderMutatingWebhookConfiguration(r.Config, caBundle)
+	var current = &admissionregistrationv1.MutatingWebhookConfiguration{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: desired.Name}, current)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		r.Log.Error(err, "get mutatingWebhook error")
+		return ctrl.Result{}, err
+	} else if k8serrors.IsNotFound(err) {
+		err = r.Client.Create(ctx, desired)
+		if err != nil {
+			r.Log.Error(err, "create mutatingWebhook error")
+		}
+		return ctrl.Result{}, err
+	}
+	if certManager {
+		// the CA bundle injected by cert-manager is kept
+		for i := range desired.Webhooks {
+			if i < len(current.Webhooks) {
+				desired.Webhooks[i].ClientConfig.CABundle = current.Webhooks[i].ClientConfig.CABundle
+			}
+		}
+	}
+	var injectFrom, injected = current.Annotations[webhook.CertManagerInjectAnnotation]
+	var annotationChanged = injectFrom != desired.Annotations[webhook.CertManagerInjectAnnotation] || injected != certManager
+	if equality.Semantic.DeepEqual(current.Webhooks, desired.Webhooks) && !annotationChanged {
+		return ctrl.Result{}, nil
+	}
+	r.Log.Info("mutatingWebhook drift from config, update it", "Name", current.Name)
+	current.Webhooks = desired.Webhooks
+	if certManager {
+		if current.Annotations == nil {
+			current.Annotations = map[string]string{}
+		}
+		current.Annotations[webhook.CertManagerInjectAnnotation] = desired.Annotations[webhook.CertManagerInjectAnnotation]
+	} else {
+		delete(current.Annotations, webhook.CertManagerInjectAnnotation)
+	}
+	err = r.Client.Update(ctx, current)
+	if err != nil {
+		r.Log.Error(err, "update mutatingWebhook error")
+	}
+	return ctrl.Result{}, err
+}
+
+func (r *WebhookConfigurationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// the configuration not exist at the first start, so it is reconciled once when the controller start
+	var initial = source.Func(func(ctx context.Context, _ handler.EventHandler, queue workqueue.RateLimitingInterface,
+		_ ...predicate.Predicate) error {
+		queue.Add(reconcile.Request{NamespacedName: types.NamespacedName{Name: webhook.ConfigurationName}})
+		return nil
+	})
+	// the CA bundle is updated when the serving certificate secret or the self signed CA changed
+	var tlsSecret = handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: webhook.ConfigurationName}}}
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("webhookconfiguration").
+		For(&admissionregistrationv1.MutatingWebhookConfiguration{}, builder.WithPredicates(
+			predicate.NewPredicateFuncs(func(object client.Object) bool {
+				return object.GetName() == webhook.ConfigurationName
+			}))).
+		Watches(initial, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, tlsSecret, builder.WithPredicates(
+			predicate.NewPredicateFuncs(func(object client.Object) bool {
+				return object.GetNamespace() == utils.GetCurrentNameSpace() && object.GetName() == webhook.TLSSecretName
+			}))).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, tlsSecret, builder.WithPredicates(
+			predicate.NewPredicateFuncs(func(object client.Object) bool {
+				return object.GetNamespace() == utils.GetCurrentNameSpace() &&
+					object.GetName() == utils.SelfSignedCAName(r.Config.ServiceName)
+			}))).Complete(r)
+}
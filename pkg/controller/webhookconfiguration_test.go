@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+	"github.com/shijunLee/docker-secret-tools/pkg/webhook"
+)
+
+func Test_WebhookConfigurationReconcile(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var serverConfig = &config.Config{ServiceName: "docker-secret-tool-webhook"}
+	var reconciler = &WebhookConfigurationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		Log:    zap.New(),
+		Config: serverConfig,
+	}
+	var ctx = context.TODO()
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Name: webhook.ConfigurationName}}
+	var key = types.NamespacedName{Name: webhook.ConfigurationName}
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	var current = &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	var desired = webhook.RenderMutatingWebhookConfiguration(serverConfig, nil)
+	if !equality.Semantic.DeepEqual(current.Webhooks, desired.Webhooks) {
+		t.Fatalf("unexpected webhooks %v", current.Webhooks)
+	}
+
+	// the drift made by others is reverted
+	current.Webhooks[0].Rules[0].Resources = []string{"pods"}
+	current.Webhooks[0].ClientConfig.Service.Name = "other"
+	if err := reconciler.Client.Update(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(current.Webhooks, desired.Webhooks) {
+		t.Fatalf("expect drift reverted, got %v", current.Webhooks)
+	}
+
+	// the config change is applied
+	serverConfig.ServiceName = "new-webhook"
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Webhooks[0].ClientConfig.Service.Name != "new-webhook" {
+		t.Fatalf("expect service name updated, got %v", current.Webhooks[0].ClientConfig.Service)
+	}
+}
+
+func Test_WebhookConfigurationSelfSignedCA(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var serverConfig = &config.Config{ServiceName: "docker-secret-tool-webhook", AutoTLS: true,
+		AutoTLSMode: config.AutoTLSModeSelfSignedCA}
+	var caConfigMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tool-test", Name: utils.SelfSignedCAName(serverConfig.ServiceName)},
+		Data:       map[string]string{utils.CACertKey: "test-ca"},
+	}
+	var reconciler = &WebhookConfigurationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(caConfigMap).Build(),
+		Log:    zap.New(),
+		Config: serverConfig,
+	}
+	var ctx = context.TODO()
+	var key = types.NamespacedName{Name: webhook.ConfigurationName}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var current = &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if string(current.Webhooks[0].ClientConfig.CABundle) != "test-ca" {
+		t.Fatalf("expect the self signed CA injected, got %s", current.Webhooks[0].ClientConfig.CABundle)
+	}
+}
+
+func Test_WebhookConfigurationCertManager(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var serverConfig = &config.Config{ServiceName: "docker-secret-tool-webhook", AutoTLS: true,
+		AutoTLSMode: config.AutoTLSModeCertManager, CertManagerIssuerName: "selfsigned"}
+	var reconciler = &WebhookConfigurationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		Log:    zap.New(),
+		Config: serverConfig,
+	}
+	var ctx = context.TODO()
+	var key = types.NamespacedName{Name: webhook.ConfigurationName}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var certificate = webhook.RenderCertificate(serverConfig)
+	if err := reconciler.Client.Get(ctx, client.ObjectKeyFromObject(certificate), certificate); err != nil {
+		t.Fatalf("expect the certificate created, got %v", err)
+	}
+	var current = &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Annotations[webhook.CertManagerInjectAnnotation] != "tool-test/docker-secret-tool-webhook" {
+		t.Fatalf("unexpected annotations %v", current.Annotations)
+	}
+
+	// the CA bundle injected by cert-manager is kept
+	current.Webhooks[0].ClientConfig.CABundle = []byte("cert-manager-ca")
+	if err := reconciler.Client.Update(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if string(current.Webhooks[0].ClientConfig.CABundle) != "cert-manager-ca" {
+		t.Fatalf("expect the injected CA kept, got %s", current.Webhooks[0].ClientConfig.CABundle)
+	}
+
+	// the annotation is removed when cert-manager is disabled
+	serverConfig.AutoTLS = false
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	current = &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := reconciler.Client.Get(ctx, key, current); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := current.Annotations[webhook.CertManagerInjectAnnotation]; ok || len(current.Webhooks[0].ClientConfig.CABundle) > 0 {
+		t.Fatalf("expect the cert-manager injection removed, got %v", current)
+	}
+}
@@ -2,19 +2,23 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
-	"strings"
+	"fmt"
+	"sync"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
 	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 )
 
@@ -24,83 +28,112 @@ type WorkloadReconciler struct {
 	Object            client.Object
 	NotManagerOwners  []string
 	DockerSecretNames []string
+	// SecretPriority the order of the injected secrets before the dockerSecretNames order
+	SecretPriority []string
+	// Recorder record the events of the honored workload annotations
+	Recorder record.EventRecorder
+	// DryRun only report the changes with Reporter
+	DryRun   bool
+	Reporter *report.Reporter
+	// recorded the injection state of each workload when the annotation events recorded, the events are
+	// recorded again only when the annotations or the pod template changed
+	lock     sync.Mutex
+	recorded map[types.NamespacedName]string
 }
 
+//Reconcile add the image secrets to the top level owner of the object, the pods and jobs can not
+// be changed after created so the secrets are patched to the workload which create them
 func (w *WorkloadReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-
-	var object = &unstructured.Unstructured{}
-	object.SetGroupVersionKind(w.Object.GetObjectKind().GroupVersionKind())
-	err := w.Client.Get(ctx, types.NamespacedName{Name: req.Name, Namespace: req.Namespace}, object)
+	gvk, err := apiutil.GVKForObject(w.Object, w.Client.Scheme())
 	if err != nil {
-		if !k8serrors.IsNotFound(err) {
-			return ctrl.Result{}, err
-		} else {
-			return ctrl.Result{}, err
-		}
+		return ctrl.Result{}, err
+	}
+	object, err := getObject(ctx, w.Client, gvk, req.NamespacedName)
+	if k8serrors.IsNotFound(err) {
+		w.forget(req.NamespacedName)
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
 	}
-	jsonData, err := object.MarshalJSON()
+	chain, err := ownerChain(ctx, w.Client, object)
 	if err != nil {
-		w.Log.Error(err, "get json data error")
+		w.Log.Error(err, "get object owners error", "Kind", object.GetKind(), "Name", object.GetName(), "Namespace", object.GetNamespace())
+		return ctrl.Result{}, err
+	}
+	for _, owner := range chain[1:] {
+		if w.notManagerOwner(owner.GetAPIVersion(), owner.GetKind()) {
+			return ctrl.Result{}, nil
+		}
 	}
-	imageList, err := utils.GetImageFromJSON(ctx, string(jsonData))
+	object = chain[len(chain)-1]
+	if !templateMutable(object.GetKind()) {
+		w.Log.Info("skip object which pod template can not be patched", "Kind", object.GetKind(), "Name", object.GetName(),
+			"Namespace", object.GetNamespace())
+		return ctrl.Result{}, nil
+	}
+	// the events are recorded on the annotated object, not when the reconcile is triggered by the objects
+	// it created, such as the pods inherit the annotations of the template
+	var recordEvents = len(chain) == 1 && w.observeInjection(object)
+	var injection = utils.ParseWorkloadInjection(object)
+	if injection.Skip {
+		if recordEvents {
+			injection.Record(w.Recorder, object, nil)
+		}
+		return ctrl.Result{}, nil
+	}
+	images, err := utils.ObjectImages(object)
 	if err != nil {
 		w.Log.Error(err, "get image from data error")
 		return ctrl.Result{}, nil
 	}
+	imageList := utils.ImageNames(images)
 	if len(imageList) == 0 {
 		return ctrl.Result{}, nil
 	}
-	imageSecrets := w.getImagesSecrets(ctx, imageList)
+	var registrySecrets = utils.GetSecretAuthRegistry(ctx, w.Client, w.Log, w.DockerSecretNames)
+	imageSecrets, missing := injection.Select(registrySecrets, imageList)
+	if recordEvents {
+		injection.Record(w.Recorder, object, missing)
+	}
+	imageSecrets = utils.OrderSecrets(imageSecrets, utils.SecretOrder(w.SecretPriority, w.DockerSecretNames))
+	var requiredSecrets []string
 	var replaceImageSecrets []string
+	var injectedSecrets []corev1.Secret
 	for _, item := range imageSecrets {
+		requiredSecrets = append(requiredSecrets, item.Name)
 		var secret = &corev1.Secret{}
 		err = w.Client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: item.Name}, secret)
 		if err != nil && k8serrors.IsNotFound(err) {
-			item.Namespace = req.Namespace
-			err = w.Client.Create(ctx, &item)
-			if err != nil {
-				w.Log.Error(err, "create secret error", "SecretName", item.Name)
+			if w.DryRun {
+				w.Reporter.Record(object, report.Action{Source: "WorkloadReconciler", Action: report.ActionCreateSecret,
+					Kind: "Secret", Namespace: req.Namespace, Name: item.Name})
 			} else {
-				replaceImageSecrets = append(replaceImageSecrets, item.Name)
+				err = w.Client.Create(ctx, utils.PropagatedSecret(item, req.Namespace))
+				if err != nil && !k8serrors.IsAlreadyExists(err) {
+					metrics.PropagationFailures.WithLabelValues(req.Namespace).Inc()
+					w.Log.Error(err, "create secret error", "SecretName", item.Name)
+					continue
+				}
 			}
 		}
+		replaceImageSecrets = append(replaceImageSecrets, item.Name)
+		injectedSecrets = append(injectedSecrets, item)
 	}
-	if len(replaceImageSecrets) > 0 {
-		var secretListKV []map[string]string
-		for _, secret := range replaceImageSecrets {
-			secretListKV = append(secretListKV, map[string]string{"name": secret})
-		}
-		var secretMaps map[string]interface{}
-		switch object.GetKind() {
-		case "Pod":
-			secretMaps = map[string]interface{}{
-				"spec": map[string]interface{}{
-					"imagePullSecrets": secretListKV,
-				},
-			}
 
-		default:
-			secretMaps = map[string]interface{}{
-				"spec": map[string]interface{}{
-					"template": map[string]interface{}{
-						"spec": map[string]interface{}{
-							"imagePullSecrets": secretListKV,
-						},
-					},
-				},
-			}
-		}
-		mergePatch, err := json.Marshal(secretMaps)
-		if err != nil {
-			w.Log.Error(err, "convert secret to json error")
-		}
-		err = w.Patch(ctx, object, client.RawPatch(types.StrategicMergePatchType, mergePatch))
-		if err != nil {
-			w.Log.Error(err, "patch object secret error", "Group", object.GroupVersionKind().Group,
-				"Version", object.GroupVersionKind().Version, "Kind", object.GroupVersionKind().Kind, "Name", object.GetName(),
-				"Namespace", object.GetNamespace())
-			return ctrl.Result{}, err
-		}
+	result, changed, err := syncPodTemplateSecrets(ctx, w.Client, object, replaceImageSecrets, requiredSecrets, w.DryRun)
+	if err != nil {
+		w.Log.Error(err, "patch object secret error", "Group", object.GroupVersionKind().Group,
+			"Version", object.GroupVersionKind().Version, "Kind", object.GroupVersionKind().Kind, "Name", object.GetName(),
+			"Namespace", object.GetNamespace())
+		return ctrl.Result{}, err
+	}
+	if changed && !w.DryRun {
+		utils.RecordInjectedSecrets(registrySecrets, injectedSecrets)
+	}
+	if changed && w.DryRun {
+		w.Reporter.Record(object, report.Action{Source: "WorkloadReconciler", Action: report.ActionPatchImagePullSecrets,
+			Kind: object.GetKind(), Namespace: object.GetNamespace(), Name: object.GetName(),
+			Detail: fmt.Sprintf("imagePullSecrets %v", result)})
 	}
 
 	return ctrl.Result{}, nil
@@ -113,79 +146,67 @@ func (w *WorkloadReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			return w.filterEventObject(event.Object)
 		},
 		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
-			return false
+			// the images may be changed, the secrets need to add or remove
+			return updateEvent.ObjectOld.GetGeneration() != updateEvent.ObjectNew.GetGeneration() &&
+				w.filterEventObject(updateEvent.ObjectNew)
 		},
 		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
-			return false
+			// the injection state of the deleted object is forgotten on reconcile
+			return w.tracked(client.ObjectKeyFromObject(deleteEvent.Object))
 		},
 	}).Complete(w)
 }
 
-func (w *WorkloadReconciler) getImagesSecrets(ctx context.Context, images []string) []corev1.Secret {
-	var regsitrySecrets = w.getSecretAuthRegistry(ctx)
-	var result = []corev1.Secret{}
-
-	for k, v := range regsitrySecrets {
-		for _, image := range images {
-			imagePathURLSplits := strings.Split(image, ":")
-			if len(imagePathURLSplits) == 0 {
-				continue
-			}
-			imagePathSplits := strings.Split(imagePathURLSplits[0], "/")
-			if len(imagePathSplits) == 0 {
-				continue
-			}
-			imageHost := imagePathSplits[0]
-			if imageHost == k {
-				for _, item := range v {
-					result = append(result, item)
-				}
-			}
-		}
+// observeInjection remember the injection state of the object and check it changed since the last time
+func (w *WorkloadReconciler) observeInjection(object *unstructured.Unstructured) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var key = client.ObjectKeyFromObject(object)
+	// only the annotated objects are kept, no event is recorded for the others
+	var injection = utils.ParseWorkloadInjection(object)
+	if !injection.Skip && len(injection.Secrets) == 0 && len(injection.Registries) == 0 {
+		delete(w.recorded, key)
+		return false
 	}
-	return result
+	var state = utils.InjectionState(object)
+	if last, ok := w.recorded[key]; ok && last == state {
+		return false
+	}
+	if w.recorded == nil {
+		w.recorded = map[types.NamespacedName]string{}
+	}
+	w.recorded[key] = state
+	return true
 }
 
-func (w *WorkloadReconciler) getSecretAuthRegistry(ctx context.Context) map[string][]corev1.Secret {
-	var result = map[string][]corev1.Secret{}
-	var secrets = utils.GetDockerSecrets(ctx, w.Client, w.Log, w.DockerSecretNames)
-	for _, item := range secrets {
-		configData, ok := item.Data[".dockerconfigjson"]
-		if ok {
-			var dockerSecrets = &utils.DockerSecrets{}
-			err := json.Unmarshal(configData, dockerSecrets)
-			if err == nil {
-				for key, _ := range dockerSecrets.Auths {
-					if values, ok := result[key]; ok {
-						values = append(values, *item)
-						result[key] = values
-					} else {
-						var values []corev1.Secret
-						values = append(values, *item)
-						result[key] = values
-					}
-				}
-			} else {
-				w.Log.Error(err, "unmarshal docker secret to docker config error")
-			}
-		}
-	}
-	return result
+func (w *WorkloadReconciler) tracked(key types.NamespacedName) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, ok := w.recorded[key]
+	return ok
+}
+
+func (w *WorkloadReconciler) forget(key types.NamespacedName) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.recorded, key)
 }
 
+// filterEventObject skip the objects owned by the not manager owners
 func (w *WorkloadReconciler) filterEventObject(object client.Object) bool {
-	ownerReference := object.GetOwnerReferences()
-	if ownerReference != nil && len(ownerReference) > 0 {
-		for _, item := range ownerReference {
-			if item.APIVersion == "apps/v1" {
-				return false
-			}
-			for _, notManagerOwner := range w.NotManagerOwners {
-				if item.APIVersion == notManagerOwner {
-					return false
-				}
-			}
+	for _, item := range object.GetOwnerReferences() {
+		if w.notManagerOwner(item.APIVersion, item.Kind) {
+			return false
 		}
 	}
 	return true
 }
+
+func (w *WorkloadReconciler) notManagerOwner(apiVersion, kind string) bool {
+	for _, notManagerOwner := range w.NotManagerOwners {
+		if ownerMatch(notManagerOwner, apiVersion, kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,33 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+
 	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 )
 
-func Test_WorkloadJsonQ(t *testing.T) {
+func Test_WorkloadImages(t *testing.T) {
 
 	var deploymentString = `
 apiVersion: apps/v1
@@ -744,18 +765,350 @@ status:
   - ip: 10.244.249.28
   qosClass: Burstable
   startTime: "2021-02-21T06:57:21Z"`
-	t.Run("deploy", func(t *testing.T) {
-		result, err := utils.GetImageFromYaml(context.TODO(), deploymentString)
-		if err != nil {
+	for name, data := range map[string]string{"deploy": deploymentString, "pod": podString} {
+		t.Run(name, func(t *testing.T) {
+			var object = &unstructured.Unstructured{}
+			if err := yaml.Unmarshal([]byte(data), &object.Object); err != nil {
+				t.Fatal(err)
+			}
+			result, err := utils.ObjectImages(object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != 1 || result[0].Name != "controller" || result[0].Type != utils.ContainerTypeRegular ||
+				result[0].Reference.Registry != "docker.shijunlee.local" || result[0].Reference.Tag != "v0.44.0" {
+				t.Fatalf("unexpected images %v", result)
+			}
+		})
+	}
+}
+
+// newTestSourceSecret the source docker secret of the docker.shijunlee.local registry in the tool namespace
+func newTestSourceSecret(name string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tool-test"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"docker.shijunlee.local":{"auth":"dGVzdDp0ZXN0"}}}`),
+		},
+	}
+}
+
+func Test_WorkloadReconcile(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	var deployment = &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: []corev1.LocalObjectReference{{Name: "user-secret"}},
+					Containers:       []corev1.Container{{Name: "nginx", Image: "docker.shijunlee.local/library/nginx:latest"}},
+				},
+			},
+		},
+	}
+	var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, deployment).Build()
+	var reconciler = &WorkloadReconciler{
+		Client:            fakeClient,
+		Log:               zap.New(),
+		Object:            &appsv1.Deployment{},
+		DockerSecretNames: []string{"tpaas-itg"},
+	}
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "nginx"}}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	var result = &appsv1.Deployment{}
+	if err := fakeClient.Get(context.TODO(), req.NamespacedName, result); err != nil {
+		t.Fatal(err)
+	}
+	var expect = []corev1.LocalObjectReference{{Name: "user-secret"}, {Name: "tpaas-itg"}}
+	if !reflect.DeepEqual(result.Spec.Template.Spec.ImagePullSecrets, expect) {
+		t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+	}
+	var secret = &corev1.Secret{}
+	if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "tpaas-itg"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels[utils.ManagedSecretLabel] != "true" {
+		t.Fatalf("expect the copied secret labeled, got %v", secret.Labels)
+	}
+
+	// the image from the registry is removed, the injected secret is pruned
+	result.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+	if err := fakeClient.Update(context.TODO(), result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeClient.Get(context.TODO(), req.NamespacedName, result); err != nil {
+		t.Fatal(err)
+	}
+	expect = []corev1.LocalObjectReference{{Name: "user-secret"}}
+	if !reflect.DeepEqual(result.Spec.Template.Spec.ImagePullSecrets, expect) {
+		t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+	}
+}
+
+func Test_WorkloadReconcileOwner(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	var podSpec = corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "docker.shijunlee.local/library/nginx:latest"}}}
+	var deployment = &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test", UID: "deployment-uid"},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+	}
+	var replicaSet = &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "test", UID: "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx",
+				UID: "deployment-uid", Controller: pointer.BoolPtr(true)}}},
+		Spec: appsv1.ReplicaSetSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+	}
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "nginx-1"}}
+
+	t.Run("not manager owner", func(t *testing.T) {
+		var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, deployment, replicaSet).Build()
+		var reconciler = &WorkloadReconciler{
+			Client:            fakeClient,
+			Log:               zap.New(),
+			Object:            &appsv1.ReplicaSet{},
+			DockerSecretNames: []string{"tpaas-itg"},
+			NotManagerOwners:  []string{"apps/v1/Deployment"},
+		}
+		if reconciler.filterEventObject(replicaSet) {
+			t.Fatal("expect the replica set is filtered")
+		}
+		if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+			t.Fatal(err)
+		}
+		var result = &appsv1.Deployment{}
+		if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "nginx"}, result); err != nil {
 			t.Fatal(err)
 		}
-		t.Log(result)
+		if len(result.Spec.Template.Spec.ImagePullSecrets) != 0 {
+			t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+		}
 	})
-	t.Run("pod", func(t *testing.T) {
-		result, err := utils.GetImageFromYaml(context.TODO(), podString)
-		if err != nil {
+
+	t.Run("patch top level owner", func(t *testing.T) {
+		var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, deployment, replicaSet).Build()
+		var reconciler = &WorkloadReconciler{
+			Client:            fakeClient,
+			Log:               zap.New(),
+			Object:            &appsv1.ReplicaSet{},
+			DockerSecretNames: []string{"tpaas-itg"},
+		}
+		if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+			t.Fatal(err)
+		}
+		var result = &appsv1.Deployment{}
+		if err := fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "nginx"}, result); err != nil {
+			t.Fatal(err)
+		}
+		var expect = []corev1.LocalObjectReference{{Name: "tpaas-itg"}}
+		if !reflect.DeepEqual(result.Spec.Template.Spec.ImagePullSecrets, expect) {
+			t.Fatalf("unexpected image pull secrets %v", result.Spec.Template.Spec.ImagePullSecrets)
+		}
+		var resultReplicaSet = &appsv1.ReplicaSet{}
+		if err := fakeClient.Get(context.TODO(), req.NamespacedName, resultReplicaSet); err != nil {
 			t.Fatal(err)
 		}
-		t.Log(result)
+		if len(resultReplicaSet.Spec.Template.Spec.ImagePullSecrets) != 0 {
+			t.Fatalf("unexpected replica set image pull secrets %v", resultReplicaSet.Spec.Template.Spec.ImagePullSecrets)
+		}
 	})
 }
+
+func Test_WorkloadReconcileSkip(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	var deployment = &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{utils.SkipAnnotation: "true"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "nginx", Image: "docker.shijunlee.local/library/nginx:latest"}},
+				},
+			},
+		},
+	}
+	var fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret, deployment).Build()
+	var recorder = record.NewFakeRecorder(10)
+	var reconciler = &WorkloadReconciler{
+		Client:            fakeClient,
+		Log:               zap.New(),
+		Recorder:          recorder,
+		Object:            &appsv1.Deployment{},
+		DockerSecretNames: []string{"tpaas-itg"},
+	}
+	var req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "nginx"}}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	var result = &appsv1.Deployment{}
+	if err := fakeClient.Get(context.TODO(), req.NamespacedName, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Spec.Template.Spec.ImagePullSecrets) != 0 {
+		t.Fatalf("expect no secret injected, got %v", result.Spec.Template.Spec.ImagePullSecrets)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, utils.EventReasonInjectionSkipped) {
+		t.Fatalf("unexpected event %s", event)
+	}
+	// the reconcile of the unchanged object and the scale update not record the event again
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	result.Spec.Replicas = pointer.Int32Ptr(3)
+	if err := fakeClient.Update(context.TODO(), result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expect no event for the unchanged annotations, got %s", <-recorder.Events)
+	}
+	// the reconcile triggered by the owned replica set not record the event on the owner
+	if err := fakeClient.Create(context.TODO(), &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "test",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx",
+				UID: result.UID, Controller: pointer.BoolPtr(true)}}},
+		Spec: appsv1.ReplicaSetSpec{Template: result.Spec.Template},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var replicaSetReconciler = &WorkloadReconciler{
+		Client:            fakeClient,
+		Log:               zap.New(),
+		Recorder:          recorder,
+		Object:            &appsv1.ReplicaSet{},
+		DockerSecretNames: []string{"tpaas-itg"},
+	}
+	var replicaSetReq = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "test", Name: "nginx-1"}}
+	if _, err := replicaSetReconciler.Reconcile(context.TODO(), replicaSetReq); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("expect no event for the owned object, got %s", <-recorder.Events)
+	}
+	// the changed annotation is recorded again
+	result.Spec.Template.Annotations[utils.SkipAnnotation] = "false"
+	result.Spec.Template.Annotations[utils.RegistriesAnnotation] = "docker.shijunlee.local"
+	if err := fakeClient.Update(context.TODO(), result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, utils.EventReasonRegistriesRequested) {
+		t.Fatalf("unexpected event %s", event)
+	}
+}
+
+func Test_SyncPodTemplateSecretsUnchanged(t *testing.T) {
+	var deployment = &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: utils.SetManagedPullSecrets(nil, []string{"zeta", "alpha"})},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: []corev1.LocalObjectReference{{Name: "zeta"}, {Name: "alpha"}},
+				},
+			},
+		},
+	}
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client is not used when nothing changed
+	_, changed, err := syncPodTemplateSecrets(context.TODO(), nil, &unstructured.Unstructured{Object: data},
+		[]string{"zeta", "alpha"}, []string{"zeta", "alpha"}, false)
+	if err != nil || changed {
+		t.Fatalf("expect the template with the sorted managed annotation unchanged, got %v %v", changed, err)
+	}
+}
+
+// ownerErrorClient the client can not read the custom resource owners
+type ownerErrorClient struct {
+	client.Client
+	err error
+}
+
+func (c *ownerErrorClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if obj.GetObjectKind().GroupVersionKind().Group == "example.com" {
+		return c.err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func Test_OwnerChainUnreadableOwner(t *testing.T) {
+	var replicaSet = &unstructured.Unstructured{}
+	replicaSet.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("ReplicaSet"))
+	replicaSet.SetNamespace("test")
+	replicaSet.SetName("nginx-1")
+	replicaSet.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "App", Name: "nginx",
+		UID: "app-uid", Controller: pointer.BoolPtr(true)}})
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var gr = schema.GroupResource{Group: "example.com", Resource: "apps"}
+	for name, err := range map[string]error{
+		"forbidden": k8serrors.NewForbidden(gr, "nginx", errors.New("no rights")),
+		"no match":  &meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: "example.com", Kind: "App"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var c = &ownerErrorClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), err: err}
+			chain, err := ownerChain(context.TODO(), c, replicaSet)
+			if err != nil || len(chain) != 1 || chain[0] != replicaSet {
+				t.Fatalf("expect the walk stop at the replica set, got %v %v", chain, err)
+			}
+		})
+	}
+}
+
+// typedReadClient fail the unstructured reads, the cached client only serve the typed objects
+type typedReadClient struct {
+	client.Client
+}
+
+func (c *typedReadClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*unstructured.Unstructured); ok {
+		return errors.New("unstructured read not cached")
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func Test_OwnerChainTypedRead(t *testing.T) {
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var deployment = &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test", UID: "deployment-uid"}}
+	var replicaSet = &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "test", UID: "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx",
+				UID: "deployment-uid", Controller: pointer.BoolPtr(true)}}},
+	}
+	var c = &typedReadClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(deployment, replicaSet).Build()}
+	object, err := getObject(context.TODO(), c, appsv1.SchemeGroupVersion.WithKind("ReplicaSet"),
+		types.NamespacedName{Namespace: "test", Name: "nginx-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := ownerChain(context.TODO(), c, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[1].GetKind() != "Deployment" || chain[1].GetName() != "nginx" {
+		t.Fatalf("unexpected owner chain %v", chain)
+	}
+}
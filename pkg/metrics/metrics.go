@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "docker_secret_tools"
+
+// Admission outcomes
+const (
+	OutcomePatched = "patched"
+	OutcomeAllowed = "allowed"
+	OutcomeError   = "error"
+)
+
+var (
+	//AdmissionRequests the admission requests handled by the webhook by kind and outcome
+	AdmissionRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "admission_requests_total",
+		Help:      "Total number of admission requests handled by the webhook by kind and outcome.",
+	}, []string{"kind", "outcome"})
+	//AdmissionDuration the latency of the admission requests by kind and outcome
+	AdmissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "admission_duration_seconds",
+		Help:      "Latency of the admission requests handled by the webhook by kind and outcome.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"kind", "outcome"})
+	//SecretsInjected the image pull secrets injected to the workloads by registry
+	SecretsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "secrets_injected_total",
+		Help:      "Total number of image pull secrets injected to the workloads by registry.",
+	}, []string{"registry"})
+	//PropagationFailures the failures to copy the docker secrets to the namespaces
+	PropagationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "secret_propagation_failures_total",
+		Help:      "Total number of failures to copy the docker secrets to the namespace.",
+	}, []string{"namespace"})
+	//CertificateExpiry the expiry time of the webhook serving certificate
+	CertificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the webhook serving certificate in unix seconds.",
+	})
+	//CredentialRefresh the last time the source docker secrets were written
+	CredentialRefresh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "credential_refresh_timestamp_seconds",
+		Help:      "Last time the source docker secret was written in unix seconds, the age is time() minus the value.",
+	}, []string{"secret"})
+)
+
+func init() {
+	// the metrics are served with the controller-runtime metrics on the manager metrics endpoint
+	metrics.Registry.MustRegister(AdmissionRequests, AdmissionDuration, SecretsInjected, PropagationFailures,
+		CertificateExpiry, CredentialRefresh)
+}
+
+//ObserveAdmission record the admission request with the latency since start
+func ObserveAdmission(kind, outcome string, start time.Time) {
+	AdmissionRequests.WithLabelValues(kind, outcome).Inc()
+	AdmissionDuration.WithLabelValues(kind, outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,154 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// maxRecentActions the max actions kept in the summary report
+	maxRecentActions = 200
+	// summaryInterval the interval to write the summary report to log
+	summaryInterval = 10 * time.Minute
+	// EventReasonDryRun the event reason of the would-be changes
+	EventReasonDryRun = "DryRun"
+)
+
+// Action types the tool would do
+const (
+	ActionCreateSecret          = "CreateSecret"
+	ActionPatchImagePullSecrets = "PatchImagePullSecrets"
+	ActionPatchServiceAccount   = "PatchServiceAccount"
+	ActionLabelSecret           = "LabelSecret"
+	ActionDeletePod             = "DeletePod"
+)
+
+//Action a change the tool would make in dry run mode
+type Action struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`
+	Action    string    `json:"action"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+//Message the human readable message of the action
+func (a Action) Message() string {
+	var message = fmt.Sprintf("dry run: %s would %s on %s %s", a.Source, a.Action, a.Kind, a.Name)
+	if a.Namespace != "" {
+		message = fmt.Sprintf("dry run: %s would %s on %s %s/%s", a.Source, a.Action, a.Kind, a.Namespace, a.Name)
+	}
+	if a.Detail != "" {
+		message = message + ": " + a.Detail
+	}
+	return message
+}
+
+//Summary the summary report of the would-be changes
+type Summary struct {
+	Since   time.Time      `json:"since"`
+	Counts  map[string]int `json:"counts"`
+	Actions []Action       `json:"actions"`
+}
+
+//Reporter record the changes the tool would make in dry run mode, each change is written to
+// the log, the event of the involved object and the summary report
+type Reporter struct {
+	log      logr.Logger
+	recorder record.EventRecorder
+	mu       sync.Mutex
+	since    time.Time
+	counts   map[string]int
+	actions  []Action
+}
+
+//NewReporter create a dry run reporter
+func NewReporter(log logr.Logger, recorder record.EventRecorder) *Reporter {
+	return &Reporter{
+		log:      log,
+		recorder: recorder,
+		since:    time.Now(),
+		counts:   map[string]int{},
+	}
+}
+
+//Record record a would-be change, the event is not created when object is nil
+func (r *Reporter) Record(object runtime.Object, action Action) {
+	if action.Time.IsZero() {
+		action.Time = time.Now()
+	}
+	r.log.Info(action.Message(), "Source", action.Source, "Action", action.Action, "Kind", action.Kind,
+		"Namespace", action.Namespace, "Name", action.Name)
+	if object != nil && r.recorder != nil {
+		r.recorder.Event(object, corev1.EventTypeNormal, EventReasonDryRun, action.Message())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[action.Action]++
+	r.actions = append(r.actions, action)
+	if len(r.actions) > maxRecentActions {
+		r.actions = r.actions[len(r.actions)-maxRecentActions:]
+	}
+}
+
+//Summary get the summary report
+func (r *Reporter) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result = Summary{
+		Since:   r.since,
+		Counts:  map[string]int{},
+		Actions: append([]Action{}, r.actions...),
+	}
+	for k, v := range r.counts {
+		result.Counts[k] = v
+	}
+	return result
+}
+
+//ServeHTTP serve the summary report as json
+func (r *Reporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(r.Summary())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+//Start write the summary report to log periodically until the context done
+func (r *Reporter) Start(ctx context.Context) error {
+	var ticker = time.NewTicker(summaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.logSummary()
+			return nil
+		case <-ticker.C:
+			r.logSummary()
+		}
+	}
+}
+
+//NeedLeaderElection every replica report the changes itself would make
+func (r *Reporter) NeedLeaderElection() bool {
+	return false
+}
+
+func (r *Reporter) logSummary() {
+	var summary = r.Summary()
+	r.log.Info("dry run summary report", "Since", summary.Since, "Counts", summary.Counts)
+}
@@ -0,0 +1,32 @@
+package report
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestReporter(t *testing.T) {
+	var recorder = record.NewFakeRecorder(10)
+	var reporter = NewReporter(zap.New(), recorder)
+	var namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	reporter.Record(namespace, Action{Source: "NamespaceReconciler", Action: ActionCreateSecret, Kind: "Secret",
+		Namespace: "test", Name: "tpaas-itg"})
+	reporter.Record(nil, Action{Source: "Webhook", Action: ActionCreateSecret, Kind: "Secret",
+		Namespace: "test", Name: "docker-dev"})
+	var summary = reporter.Summary()
+	if summary.Counts[ActionCreateSecret] != 2 || len(summary.Actions) != 2 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expect one event, got %d", len(recorder.Events))
+	}
+	event := <-recorder.Events
+	if !strings.Contains(event, EventReasonDryRun) || !strings.Contains(event, "test/tpaas-itg") {
+		t.Fatalf("unexpected event %s", event)
+	}
+}
@@ -0,0 +1,179 @@
+package secretcache
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	secretGVK    = corev1.SchemeGroupVersion.WithKind("Secret")
+	configMapGVK = corev1.SchemeGroupVersion.WithKind("ConfigMap")
+)
+
+//New create the manager cache which only keep the secrets and configmaps of the source namespace and the
+// secrets labeled by the managedSelector in other namespaces, the other objects are cached cluster wide. The
+// other secrets and configmaps are read from the api server without cache
+func New(namespace string, managedSelector string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		defaultCache, err := cache.New(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		var sourceOpts = opts
+		sourceOpts.Namespace = namespace
+		sourceCache, err := cache.New(config, sourceOpts)
+		if err != nil {
+			return nil, err
+		}
+		apiReader, err := client.New(config, client.Options{Scheme: opts.Scheme, Mapper: opts.Mapper})
+		if err != nil {
+			return nil, err
+		}
+		kubeClient, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		var factory = informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = managedSelector
+			}))
+		// the informer is registered to the factory before the factory start
+		var managed = factory.Core().V1().Secrets()
+		return &secretCache{
+			Cache:          defaultCache,
+			namespace:      namespace,
+			source:         sourceCache,
+			managedFactory: factory,
+			managed:        managed.Informer(),
+			managedLister:  managed.Lister(),
+			apiReader:      apiReader,
+		}, nil
+	}
+}
+
+// secretCache route the secrets to the source namespace cache or the managed secrets informer
+type secretCache struct {
+	// Cache the cluster wide cache of the objects except secrets
+	cache.Cache
+	namespace string
+	// source the cache of the source namespace, the secret informers are got from it
+	source         cache.Cache
+	managedFactory informers.SharedInformerFactory
+	managed        toolscache.SharedIndexInformer
+	managedLister  listerscorev1.SecretLister
+	// apiReader read the secrets not cached
+	apiReader client.Reader
+}
+
+func isSecret(obj interface{}) bool {
+	switch obj.(type) {
+	case *corev1.Secret, *corev1.SecretList:
+		return true
+	}
+	return false
+}
+
+func isConfigMap(obj interface{}) bool {
+	switch obj.(type) {
+	case *corev1.ConfigMap, *corev1.ConfigMapList:
+		return true
+	}
+	return false
+}
+
+//Get get the secret of the source namespace from the source cache, the secret of other namespaces from the
+// managed secrets informer or the api server when it not labeled
+func (c *secretCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if !isSecret(obj) && !isConfigMap(obj) {
+		return c.Cache.Get(ctx, key, obj)
+	}
+	if key.Namespace == c.namespace {
+		return c.source.Get(ctx, key, obj)
+	}
+	if isConfigMap(obj) {
+		return c.apiReader.Get(ctx, key, obj)
+	}
+	secret, err := c.managedLister.Secrets(key.Namespace).Get(key.Name)
+	if k8serrors.IsNotFound(err) {
+		return c.apiReader.Get(ctx, key, obj)
+	} else if err != nil {
+		return err
+	}
+	secret.DeepCopyInto(obj.(*corev1.Secret))
+	return nil
+}
+
+//List list the secrets and configmaps of the source namespace from the source cache, others from the api server
+func (c *secretCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if !isSecret(list) && !isConfigMap(list) {
+		return c.Cache.List(ctx, list, opts...)
+	}
+	var listOpts = &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if listOpts.Namespace == c.namespace {
+		return c.source.List(ctx, list, opts...)
+	}
+	return c.apiReader.List(ctx, list, opts...)
+}
+
+//GetInformer the secret and configmap informers only watch the source namespace
+func (c *secretCache) GetInformer(ctx context.Context, obj client.Object) (cache.Informer, error) {
+	if isSecret(obj) || isConfigMap(obj) {
+		return c.source.GetInformer(ctx, obj)
+	}
+	return c.Cache.GetInformer(ctx, obj)
+}
+
+//GetInformerForKind the secret and configmap informers only watch the source namespace
+func (c *secretCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk == secretGVK || gvk == configMapGVK {
+		return c.source.GetInformerForKind(ctx, gvk)
+	}
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+//IndexField the secret and configmap fields are indexed in the source namespace cache
+func (c *secretCache) IndexField(ctx context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	if isSecret(obj) || isConfigMap(obj) {
+		return c.source.IndexField(ctx, obj, field, extractValue)
+	}
+	return c.Cache.IndexField(ctx, obj, field, extractValue)
+}
+
+//Start start all the caches and block until the context is done
+func (c *secretCache) Start(ctx context.Context) error {
+	var errs = make(chan error, 2)
+	go func() {
+		errs <- c.source.Start(ctx)
+	}()
+	go func() {
+		errs <- c.Cache.Start(ctx)
+	}()
+	c.managedFactory.Start(ctx.Done())
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			return fmt.Errorf("start cache error: %w", err)
+		}
+	}
+	return nil
+}
+
+//WaitForCacheSync wait all the caches synced
+func (c *secretCache) WaitForCacheSync(ctx context.Context) bool {
+	if !c.Cache.WaitForCacheSync(ctx) || !c.source.WaitForCacheSync(ctx) {
+		return false
+	}
+	return toolscache.WaitForCacheSync(ctx.Done(), c.managed.HasSynced)
+}
@@ -0,0 +1,118 @@
+package secretcache
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testCache the fake informers read the objects from the fake client
+type testCache struct {
+	*informertest.FakeInformers
+	reader client.Reader
+}
+
+func (c *testCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.reader.Get(ctx, key, obj)
+}
+
+func (c *testCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.reader.List(ctx, list, opts...)
+}
+
+func testSecret(namespace, name string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+func testConfigMap(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+}
+
+func Test_SecretCache(t *testing.T) {
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var ctx, cancel = context.WithCancel(context.TODO())
+	defer cancel()
+	var managedLabels = map[string]string{"secret-tools.io/managed": "true"}
+	var kubeClient = kubefake.NewSimpleClientset(testSecret("app", "managed", managedLabels), testSecret("app", "other", nil))
+	var factory = informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = "secret-tools.io/managed=true"
+		}))
+	var managed = factory.Core().V1().Secrets()
+	var defaultInformers = &informertest.FakeInformers{Scheme: scheme}
+	var sourceInformers = &informertest.FakeInformers{Scheme: scheme}
+	var c = &secretCache{
+		Cache:     &testCache{FakeInformers: defaultInformers, reader: fake.NewClientBuilder().WithScheme(scheme).Build()},
+		namespace: "tool-test",
+		source: &testCache{FakeInformers: sourceInformers,
+			reader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(testSecret("tool-test", "source", nil), testConfigMap("tool-test", "kube-root-ca.crt")).Build()},
+		managedFactory: factory,
+		managed:        managed.Informer(),
+		managedLister:  managed.Lister(),
+		apiReader: fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(testSecret("app", "unmanaged", nil), testConfigMap("app", "app-config")).Build(),
+	}
+	factory.Start(ctx.Done())
+	if !toolscache.WaitForCacheSync(ctx.Done(), c.managed.HasSynced) {
+		t.Fatal("managed informer not synced")
+	}
+
+	// the source secret is read from the source namespace cache
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "tool-test", Name: "source"}, &corev1.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+	// the managed secret is read from the managed informer
+	var secret = &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "app", Name: "managed"}, secret); err != nil || secret.Name != "managed" {
+		t.Fatalf("expect the managed secret, got %v %v", secret, err)
+	}
+	// the secret without the label is not cached and read from the api server
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "app", Name: "other"}, &corev1.Secret{}); err == nil {
+		t.Fatal("expect the unlabeled secret not read from the managed informer")
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "app", Name: "unmanaged"}, &corev1.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the secret informer only watch the source namespace
+	if _, err := c.GetInformer(ctx, &corev1.Secret{}); err != nil {
+		t.Fatal(err)
+	}
+	var secretGVK = corev1.SchemeGroupVersion.WithKind("Secret")
+	if _, ok := sourceInformers.InformersByGVK[secretGVK]; !ok {
+		t.Fatal("expect the secret informer created in the source cache")
+	}
+	if _, ok := defaultInformers.InformersByGVK[secretGVK]; ok {
+		t.Fatal("expect no cluster wide secret informer")
+	}
+
+	// the configmaps of the source namespace are cached, others are read from the api server
+	if _, err := c.GetInformer(ctx, &corev1.ConfigMap{}); err != nil {
+		t.Fatal(err)
+	}
+	var configMapGVK = corev1.SchemeGroupVersion.WithKind("ConfigMap")
+	if _, ok := sourceInformers.InformersByGVK[configMapGVK]; !ok {
+		t.Fatal("expect the configmap informer created in the source cache")
+	}
+	if _, ok := defaultInformers.InformersByGVK[configMapGVK]; ok {
+		t.Fatal("expect no cluster wide configmap informer")
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "tool-test", Name: "kube-root-ca.crt"}, &corev1.ConfigMap{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "app", Name: "app-config"}, &corev1.ConfigMap{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// cacheSyncTimeout the time the readiness check wait the informers sync
+const cacheSyncTimeout = time.Second
+
+//CacheSyncChecker the readiness check pass when all the informers of the cache are synced
+func CacheSyncChecker(informers cache.Informers) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), cacheSyncTimeout)
+		defer cancel()
+		if !informers.WaitForCacheSync(ctx) {
+			return errors.New("informers not synced")
+		}
+		return nil
+	}
+}
+
+//SourceSecretsChecker the readiness check pass when any docker secret in dockerSecretNames can be read from
+// the current namespace, the secrets can not be resolved are logged when the problems changed
+func SourceSecretsChecker(reader client.Reader, log logr.Logger, dockerSecretNames []string) healthz.Checker {
+	var lock sync.Mutex
+	var lastProblems string
+	return func(req *http.Request) error {
+		var errs []string
+		var resolved = 0
+		for _, item := range dockerSecretNames {
+			var secret = &corev1.Secret{}
+			err := reader.Get(req.Context(), types.NamespacedName{Namespace: GetCurrentNameSpace(), Name: item}, secret)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", item, err))
+				continue
+			}
+			if secret.Type != corev1.SecretTypeDockerConfigJson {
+				errs = append(errs, fmt.Sprintf("%s: unsupported secret type %s", item, secret.Type))
+				continue
+			}
+			resolved++
+		}
+		var problems = strings.Join(errs, "; ")
+		lock.Lock()
+		if problems != lastProblems && problems != "" {
+			log.Info("source secrets not resolved", "Problems", problems)
+		}
+		lastProblems = problems
+		lock.Unlock()
+		if resolved == 0 && len(dockerSecretNames) > 0 {
+			return fmt.Errorf("no source secret resolved, %s", problems)
+		}
+		return nil
+	}
+}
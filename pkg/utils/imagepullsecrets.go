@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+)
+
+// ManagedPullSecretsAnnotation record the imagePullSecrets added by the tool on the pod template,
+// only the secrets in this annotation will be removed when no image need them
+const ManagedPullSecretsAnnotation = "secret-tools.io/managed-pull-secrets"
+
+//ParseManagedPullSecrets parse the managed pull secrets annotation value to secret names
+func ParseManagedPullSecrets(annotations map[string]string) []string {
+	return splitList(annotations[ManagedPullSecretsAnnotation])
+}
+
+//SetManagedPullSecrets set the managed pull secrets annotation, the annotation is removed when managed is empty
+func SetManagedPullSecrets(annotations map[string]string, managed []string) map[string]string {
+	if len(managed) == 0 {
+		delete(annotations, ManagedPullSecretsAnnotation)
+		return annotations
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	var values = append([]string{}, managed...)
+	sort.Strings(values)
+	annotations[ManagedPullSecretsAnnotation] = strings.Join(values, ",")
+	return annotations
+}
+
+//MergeImagePullSecrets merge the secrets the tool want to add into the current imagePullSecrets.
+// current is the secret names on the pod template, managed is the names added by the tool before,
+// add is the secrets to add and required is all the secrets the current images need.
+// The managed secrets not in add and required are removed, the secrets not added by the tool never be removed.
+func MergeImagePullSecrets(current, managed, add, required []string) (result []string, resultManaged []string) {
+	for _, item := range current {
+		if containString(managed, item) && !containString(required, item) && !containString(add, item) {
+			continue
+		}
+		result = append(result, item)
+		if containString(managed, item) && !containString(resultManaged, item) {
+			resultManaged = append(resultManaged, item)
+		}
+	}
+	for _, item := range add {
+		if containString(result, item) {
+			continue
+		}
+		result = append(result, item)
+		resultManaged = append(resultManaged, item)
+	}
+	return result, resultManaged
+}
+
+func containString(array []string, value string) bool {
+	for _, item := range array {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
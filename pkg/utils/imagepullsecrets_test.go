@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeImagePullSecrets(t *testing.T) {
+	var tests = []struct {
+		name          string
+		current       []string
+		managed       []string
+		add           []string
+		required      []string
+		expect        []string
+		expectManaged []string
+	}{
+		{name: "add", current: []string{"user"}, add: []string{"tool"}, required: []string{"tool"},
+			expect: []string{"user", "tool"}, expectManaged: []string{"tool"}},
+		{name: "user secret is not managed", current: []string{"tool"}, add: []string{"tool"}, required: []string{"tool"},
+			expect: []string{"tool"}},
+		{name: "prune", current: []string{"user", "tool"}, managed: []string{"tool"},
+			expect: []string{"user"}},
+		{name: "keep required", current: []string{"user", "tool"}, managed: []string{"tool"}, required: []string{"tool"},
+			expect: []string{"user", "tool"}, expectManaged: []string{"tool"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, managed := MergeImagePullSecrets(test.current, test.managed, test.add, test.required)
+			if !reflect.DeepEqual(result, test.expect) || !reflect.DeepEqual(managed, test.expectManaged) {
+				t.Fatalf("got %v %v, expect %v %v", result, managed, test.expect, test.expectManaged)
+			}
+		})
+	}
+}
+
+func TestManagedPullSecretsAnnotation(t *testing.T) {
+	annotations := SetManagedPullSecrets(nil, []string{"b", "a"})
+	if annotations[ManagedPullSecretsAnnotation] != "a,b" {
+		t.Fatalf("unexpected annotation %v", annotations)
+	}
+	if managed := ParseManagedPullSecrets(annotations); !reflect.DeepEqual(managed, []string{"a", "b"}) {
+		t.Fatalf("unexpected managed secrets %v", managed)
+	}
+	if annotations = SetManagedPullSecrets(annotations, nil); len(annotations) != 0 {
+		t.Fatalf("unexpected annotation %v", annotations)
+	}
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+//ContainerType the type of the container in the pod spec
+type ContainerType string
+
+// Container types
+const (
+	ContainerTypeInit      ContainerType = "init"
+	ContainerTypeRegular   ContainerType = "regular"
+	ContainerTypeEphemeral ContainerType = "ephemeral"
+)
+
+// defaultRegistry the registry of the images without registry host
+const defaultRegistry = "docker.io"
+
+//ImageReference the parsed image reference, registry/repository:tag@digest
+type ImageReference struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+//ContainerImage the image of a container in the pod spec
+type ContainerImage struct {
+	Name      string         `json:"name"`
+	Type      ContainerType  `json:"type"`
+	Image     string         `json:"image"`
+	Reference ImageReference `json:"reference"`
+}
+
+//ParseImageReference parse the image reference, the registry is docker.io when the image has no registry host
+func ParseImageReference(image string) (ImageReference, error) {
+	var reference = ImageReference{}
+	var name = strings.TrimSpace(image)
+	if name == "" {
+		return reference, fmt.Errorf("invalid image reference %q: empty", image)
+	}
+	if index := strings.Index(name, "@"); index >= 0 {
+		reference.Digest = name[index+1:]
+		name = name[:index]
+		if reference.Digest == "" {
+			return reference, fmt.Errorf("invalid image reference %q: empty digest", image)
+		}
+	}
+	// the tag separator is after the last path separator, the colon before it is the registry port
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		reference.Tag = name[index+1:]
+		name = name[:index]
+		if reference.Tag == "" {
+			return reference, fmt.Errorf("invalid image reference %q: empty tag", image)
+		}
+	}
+	reference.Registry = defaultRegistry
+	// the first component is the registry host only when it looks like a host
+	if index := strings.Index(name, "/"); index >= 0 {
+		var host = name[:index]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			reference.Registry = host
+			name = name[index+1:]
+		}
+	}
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+		return reference, fmt.Errorf("invalid image reference %q: invalid repository", image)
+	}
+	reference.Repository = name
+	return reference, nil
+}
+
+//PodSpecImages the images of all the init, regular and ephemeral containers in the pod spec, the containers
+// which image can not be parsed are returned with the registry of the image as written
+func PodSpecImages(spec *corev1.PodSpec) []ContainerImage {
+	var result = make([]ContainerImage, 0, len(spec.InitContainers)+len(spec.Containers)+len(spec.EphemeralContainers))
+	var add = func(name, image string, containerType ContainerType) {
+		var item = ContainerImage{Name: name, Type: containerType, Image: image}
+		reference, err := ParseImageReference(image)
+		if err != nil {
+			reference = ImageReference{Registry: ImageRegistry(image)}
+		}
+		item.Reference = reference
+		result = append(result, item)
+	}
+	for _, container := range spec.InitContainers {
+		add(container.Name, container.Image, ContainerTypeInit)
+	}
+	for _, container := range spec.Containers {
+		add(container.Name, container.Image, ContainerTypeRegular)
+	}
+	for _, container := range spec.EphemeralContainers {
+		add(container.Name, container.Image, ContainerTypeEphemeral)
+	}
+	return result
+}
+
+// podSpecPaths the pod spec paths tried in order for the kinds not known
+var podSpecPaths = [][]string{
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+	{"spec"},
+}
+
+//PodSpecPath the pod spec path in the workload object, ok is false when the kind is unknown
+func PodSpecPath(kind string) (path []string, ok bool) {
+	switch kind {
+	case "Pod":
+		return []string{"spec"}, true
+	case "PodTemplate":
+		return []string{"template", "spec"}, true
+	case "Deployment", "DaemonSet", "StatefulSet", "ReplicaSet", "ReplicationController", "Job":
+		return []string{"spec", "template", "spec"}, true
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template", "spec"}, true
+	default:
+		return nil, false
+	}
+}
+
+//ObjectPodSpec get the pod spec of the workload object, nil when the object has no pod spec
+func ObjectPodSpec(object *unstructured.Unstructured) (*corev1.PodSpec, error) {
+	var paths = podSpecPaths
+	if path, ok := PodSpecPath(object.GetKind()); ok {
+		paths = [][]string{path}
+	}
+	for _, path := range paths {
+		value, found, err := unstructured.NestedMap(object.Object, path...)
+		if err != nil || !found {
+			continue
+		}
+		// the spec of other kinds may not be a pod spec
+		if _, ok := value["containers"]; !ok {
+			continue
+		}
+		var spec = &corev1.PodSpec{}
+		if err = runtime.DefaultUnstructuredConverter.FromUnstructured(value, spec); err != nil {
+			return nil, fmt.Errorf("convert %s of %s to pod spec error: %w", strings.Join(path, "."), object.GetKind(), err)
+		}
+		return spec, nil
+	}
+	return nil, nil
+}
+
+//ObjectImages the images of the workload object pod spec, empty when the object has no pod spec
+func ObjectImages(object *unstructured.Unstructured) ([]ContainerImage, error) {
+	spec, err := ObjectPodSpec(object)
+	if err != nil || spec == nil {
+		return nil, err
+	}
+	return PodSpecImages(spec), nil
+}
+
+//ImageNames the images of the containers
+func ImageNames(images []ContainerImage) []string {
+	var result = make([]string, 0, len(images))
+	for _, item := range images {
+		result = append(result, item.Image)
+	}
+	return result
+}
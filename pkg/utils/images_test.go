@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseImageReference(t *testing.T) {
+	var cases = []struct {
+		image  string
+		expect ImageReference
+		err    bool
+	}{
+		{image: "nginx", expect: ImageReference{Registry: "docker.io", Repository: "nginx"}},
+		{image: "library/nginx:1.19", expect: ImageReference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.19"}},
+		{image: "docker.shijunlee.local/library/nginx:latest",
+			expect: ImageReference{Registry: "docker.shijunlee.local", Repository: "library/nginx", Tag: "latest"}},
+		{image: "registry:5000/app", expect: ImageReference{Registry: "registry:5000", Repository: "app"}},
+		{image: "localhost/app:v1@sha256:abc",
+			expect: ImageReference{Registry: "localhost", Repository: "app", Tag: "v1", Digest: "sha256:abc"}},
+		{image: "", err: true},
+		{image: "nginx:", err: true},
+		{image: "nginx@", err: true},
+		{image: "docker.io/", err: true},
+	}
+	for _, item := range cases {
+		reference, err := ParseImageReference(item.image)
+		if (err != nil) != item.err {
+			t.Fatalf("unexpected error of %q: %v", item.image, err)
+		}
+		if err == nil && reference != item.expect {
+			t.Fatalf("unexpected reference of %q: %+v", item.image, reference)
+		}
+	}
+}
+
+func newTestObject(t testing.TB, data string) *unstructured.Unstructured {
+	var object = &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+var testCronJob = `{"apiVersion":"batch/v1beta1","kind":"CronJob","metadata":{"name":"test"},"spec":{"jobTemplate":{"spec":{"template":{"spec":{
+"initContainers":[{"name":"init","image":"docker.shijunlee.local/busybox:1.33"}],
+"containers":[{"name":"job","image":"docker.shijunlee.local/job:v1"}]}}}}}}`
+
+func TestObjectImages(t *testing.T) {
+	images, err := ObjectImages(newTestObject(t, testCronJob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Type != ContainerTypeInit || images[0].Name != "init" ||
+		images[1].Type != ContainerTypeRegular || images[1].Reference.Repository != "job" {
+		t.Fatalf("unexpected cronjob images %+v", images)
+	}
+
+	// the pod spec of the kinds not known is found in the common paths
+	images, err = ObjectImages(newTestObject(t, `{"apiVersion":"apps.kruise.io/v1alpha1","kind":"CloneSet","spec":{"template":{"spec":{
+"containers":[{"name":"app","image":"app:v1"}],"ephemeralContainers":[{"name":"debug","image":"busybox"}]}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Type != ContainerTypeEphemeral || images[1].Reference.Registry != "docker.io" {
+		t.Fatalf("unexpected clone set images %+v", images)
+	}
+
+	// the object without pod spec has no images
+	images, err = ObjectImages(newTestObject(t, `{"apiVersion":"v1","kind":"ConfigMap","data":{"a":"b"}}`))
+	if err != nil || len(images) != 0 {
+		t.Fatalf("expect no images, got %v %v", images, err)
+	}
+	if _, err = ObjectImages(newTestObject(t, `{"apiVersion":"v1","kind":"Pod","spec":{"containers":"broken"}}`)); err == nil {
+		t.Fatal("expect error for the broken pod spec")
+	}
+}
+
+func FuzzParseImageReference(f *testing.F) {
+	for _, item := range []string{"nginx", "docker.shijunlee.local/library/nginx:latest", "registry:5000/app@sha256:abc", ":", "a//b"} {
+		f.Add(item)
+	}
+	f.Fuzz(func(t *testing.T, image string) {
+		reference, err := ParseImageReference(image)
+		if err != nil {
+			return
+		}
+		if reference.Registry == "" || reference.Repository == "" {
+			t.Fatalf("empty registry or repository of %q: %+v", image, reference)
+		}
+		if strings.Contains(reference.Repository, "@") || strings.HasPrefix(reference.Repository, "/") {
+			t.Fatalf("invalid repository of %q: %+v", image, reference)
+		}
+		if ImageRegistry(image) != reference.Registry {
+			t.Fatalf("expect the registry of %q is %s, got %s", image, reference.Registry, ImageRegistry(image))
+		}
+	})
+}
+
+func FuzzObjectImages(f *testing.F) {
+	f.Add(testCronJob)
+	f.Add(`{"kind":"Pod","spec":{"containers":[{"name":"a","image":"b"}]}}`)
+	f.Add(`{"kind":"Deployment","spec":{"template":{"spec":{"containers":null}}}}`)
+	f.Fuzz(func(t *testing.T, data string) {
+		var object = &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON([]byte(data)); err != nil {
+			return
+		}
+		images, err := ObjectImages(object)
+		if err != nil {
+			return
+		}
+		for _, item := range images {
+			if item.Type == "" {
+				t.Fatalf("empty container type of %+v", item)
+			}
+		}
+	})
+}
+
+var benchmarkPod = func() string {
+	var spec = corev1.PodSpec{}
+	for _, name := range []string{"a", "b", "c"} {
+		spec.InitContainers = append(spec.InitContainers, corev1.Container{Name: "init-" + name, Image: "docker.shijunlee.local/init/" + name + ":v1"})
+		spec.Containers = append(spec.Containers, corev1.Container{Name: name, Image: "docker.shijunlee.local/app/" + name + ":v1"})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment",
+		"spec": map[string]interface{}{"template": map[string]interface{}{"spec": spec}}})
+	return string(data)
+}()
+
+func BenchmarkObjectImages(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var object = &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON([]byte(benchmarkPod)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ObjectImages(object); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseImageReference(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseImageReference("docker.shijunlee.local:5000/library/nginx:1.19@sha256:abc"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
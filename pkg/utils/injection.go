@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// The annotations on the workload or its pod template which change the injected image secrets
+const (
+	// SkipAnnotation no image secret is injected to the workload when it is "true"
+	SkipAnnotation = "secret-tools.io/skip"
+	// SecretsAnnotation the source secret names always injected, separated by comma
+	SecretsAnnotation = "secret-tools.io/secrets"
+	// RegistriesAnnotation the registry hosts which secrets are always injected, separated by comma
+	RegistriesAnnotation = "secret-tools.io/registries"
+)
+
+// The event reasons of the honored annotations
+const (
+	EventReasonInjectionSkipped    = "InjectionSkipped"
+	EventReasonSecretsRequested    = "SecretsRequested"
+	EventReasonRegistriesRequested = "RegistriesRequested"
+)
+
+//WorkloadInjection the image secrets injection options set by the annotations of the workload
+type WorkloadInjection struct {
+	Skip       bool
+	Secrets    []string
+	Registries []string
+}
+
+//ParseWorkloadInjection parse the injection annotations of the workload and its pod template, the pod
+// template annotations override the workload annotations
+func ParseWorkloadInjection(object *unstructured.Unstructured) WorkloadInjection {
+	var annotations = map[string]string{}
+	for key, value := range object.GetAnnotations() {
+		annotations[key] = value
+	}
+	if path, ok := PodSpecPath(object.GetKind()); ok && len(path) > 1 {
+		var metadataPath = append(append([]string{}, path[:len(path)-1]...), "metadata", "annotations")
+		templateAnnotations, _, _ := unstructured.NestedStringMap(object.Object, metadataPath...)
+		for key, value := range templateAnnotations {
+			annotations[key] = value
+		}
+	}
+	skip, _ := strconv.ParseBool(strings.TrimSpace(annotations[SkipAnnotation]))
+	return WorkloadInjection{
+		Skip:       skip,
+		Secrets:    splitList(annotations[SecretsAnnotation]),
+		Registries: splitList(annotations[RegistriesAnnotation]),
+	}
+}
+
+//Select the secrets to inject for the images, the secrets matched by the image registries and the secrets
+// requested by the annotations. missing is the requested secret names and registries which have no source
+// docker secret. Nothing is selected when the workload skip the injection
+func (w WorkloadInjection) Select(registrySecrets map[string][]corev1.Secret, images []string) (secrets []corev1.Secret, missing []string) {
+	if w.Skip {
+		return nil, nil
+	}
+	secrets = MatchImagesSecrets(registrySecrets, images)
+	var names []string
+	for _, item := range secrets {
+		names = append(names, item.Name)
+	}
+	var add = func(secret corev1.Secret) {
+		if !containString(names, secret.Name) {
+			names = append(names, secret.Name)
+			secrets = append(secrets, secret)
+		}
+	}
+	for _, registry := range w.Registries {
+		if len(registrySecrets[registry]) == 0 {
+			missing = append(missing, registry)
+		}
+		for _, item := range registrySecrets[registry] {
+			add(item)
+		}
+	}
+	for _, name := range w.Secrets {
+		secret, ok := findRegistrySecret(registrySecrets, name)
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		add(secret)
+	}
+	return secrets, missing
+}
+
+//Record record an event on the object for each honored annotation, the recorder may be nil
+func (w WorkloadInjection) Record(recorder record.EventRecorder, object runtime.Object, missing []string) {
+	if recorder == nil {
+		return
+	}
+	if w.Skip {
+		recorder.Eventf(object, corev1.EventTypeNormal, EventReasonInjectionSkipped,
+			"image secrets injection skipped by annotation %s", SkipAnnotation)
+		return
+	}
+	var eventType = corev1.EventTypeNormal
+	var suffix = ""
+	if len(missing) > 0 {
+		eventType = corev1.EventTypeWarning
+		suffix = fmt.Sprintf(", no source docker secret for %s", strings.Join(missing, ","))
+	}
+	if len(w.Secrets) > 0 {
+		recorder.Eventf(object, eventType, EventReasonSecretsRequested, "secrets %s requested by annotation %s%s",
+			strings.Join(w.Secrets, ","), SecretsAnnotation, suffix)
+	}
+	if len(w.Registries) > 0 {
+		recorder.Eventf(object, eventType, EventReasonRegistriesRequested, "registries %s requested by annotation %s%s",
+			strings.Join(w.Registries, ","), RegistriesAnnotation, suffix)
+	}
+}
+
+//InjectionState the digest of the injection annotations and the pod template spec of the workload, the
+// annotation events are recorded again only when it changed, not for the scale and status updates. The
+// imagePullSecrets are not included so the secrets patched by the tool not change the state
+func InjectionState(object *unstructured.Unstructured) string {
+	var podSpec, _ = ObjectPodSpec(object)
+	if podSpec != nil {
+		podSpec = podSpec.DeepCopy()
+		podSpec.ImagePullSecrets = nil
+	}
+	data, _ := json.Marshal(struct {
+		Injection WorkloadInjection
+		PodSpec   *corev1.PodSpec
+	}{ParseWorkloadInjection(object), podSpec})
+	var sum = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// findRegistrySecret find the source docker secret by name in the secrets group by registry
+func findRegistrySecret(registrySecrets map[string][]corev1.Secret, name string) (corev1.Secret, bool) {
+	for _, secrets := range registrySecrets {
+		for _, item := range secrets {
+			if item.Name == name {
+				return item, true
+			}
+		}
+	}
+	return corev1.Secret{}, false
+}
+
+// splitList split the comma separated annotation value, the empty and duplicated items are removed
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && !containString(result, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseWorkloadInjection(t *testing.T) {
+	var object = &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "Deployment",
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{SkipAnnotation: "true", SecretsAnnotation: "first, second,first"},
+		},
+		"spec": map[string]interface{}{"template": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{SkipAnnotation: "false", RegistriesAnnotation: "b.registry"},
+			},
+		}},
+	}}
+	var injection = ParseWorkloadInjection(object)
+	if injection.Skip {
+		t.Fatal("expect the pod template annotation override the workload annotation")
+	}
+	if fmt.Sprint(injection.Secrets) != "[first second]" || fmt.Sprint(injection.Registries) != "[b.registry]" {
+		t.Fatalf("unexpected injection %+v", injection)
+	}
+}
+
+func TestWorkloadInjectionSelect(t *testing.T) {
+	var registrySecrets = map[string][]corev1.Secret{
+		"a.registry": {*newTestDockerSecret("first", "a.registry")},
+		"b.registry": {*newTestDockerSecret("second", "b.registry")},
+		"c.registry": {*newTestDockerSecret("third", "c.registry")},
+	}
+	var images = []string{"a.registry/app:v1"}
+	var injection = WorkloadInjection{Secrets: []string{"third", "first", "unknown"}, Registries: []string{"b.registry", "d.registry"}}
+	secrets, missing := injection.Select(registrySecrets, images)
+	var names []string
+	for _, item := range secrets {
+		names = append(names, item.Name)
+	}
+	if fmt.Sprint(names) != "[first second third]" {
+		t.Fatalf("unexpected secrets %v", names)
+	}
+	if fmt.Sprint(missing) != "[d.registry unknown]" {
+		t.Fatalf("unexpected missing %v", missing)
+	}
+	var recorder = record.NewFakeRecorder(10)
+	injection.Record(recorder, &corev1.Secret{}, missing)
+	for _, reason := range []string{EventReasonSecretsRequested, EventReasonRegistriesRequested} {
+		if event := <-recorder.Events; !strings.Contains(event, reason) || !strings.HasPrefix(event, corev1.EventTypeWarning) {
+			t.Fatalf("unexpected event %s", event)
+		}
+	}
+
+	injection.Skip = true
+	if secrets, _ = injection.Select(registrySecrets, images); len(secrets) != 0 {
+		t.Fatalf("expect no secret selected when skip, got %v", secrets)
+	}
+	injection.Record(recorder, &corev1.Secret{}, nil)
+	if event := <-recorder.Events; !strings.Contains(event, EventReasonInjectionSkipped) {
+		t.Fatalf("unexpected event %s", event)
+	}
+}
@@ -2,27 +2,36 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/thedevsaddam/gojsonq"
 	certificatesv1 "k8s.io/api/certificates/v1"
 	certificatesV1beta1 "k8s.io/api/certificates/v1beta1"
 	corev1 "k8s.io/api/core/v1"
-	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/util/certificate/csr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/yaml"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
 )
 
-const currentNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+const (
+	currentNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	serviceAccountCAPath = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// rootCAConfigMapName the configmap published to all namespaces by the kube-controller-manager
+	rootCAConfigMapName = "kube-root-ca.crt"
+)
 
 //GetCurrentNameSpace get current pods run namespace
 func GetCurrentNameSpace() string {
@@ -41,37 +50,6 @@ func GetCurrentNameSpace() string {
 	return string(data)
 }
 
-// GetImageFromJSON get image info from workload object json string
-func GetImageFromJSON(ctx context.Context, jsonString string) (imageList []string, err error) {
-	data := gojsonq.New().FromString(jsonString).Find("spec.template.spec.containers")
-	if data == nil {
-		data = gojsonq.New().FromString(jsonString).Find("spec.containers")
-	}
-	dataInterface, ok := data.([]interface{})
-	if !ok {
-		return nil, errors.New("convert type to []interface error")
-	}
-	for _, item := range dataInterface {
-		if mapDatas, ok := item.(map[string]interface{}); ok {
-			if image, ok := mapDatas["image"]; ok {
-				imageList = append(imageList, image.(string))
-			}
-		} else {
-			return nil, errors.New("convert type to map[string]interface{} error")
-		}
-	}
-	return
-}
-
-//GetImageFromYaml get image from workload object yaml
-func GetImageFromYaml(ctx context.Context, yamlString string) (imageList []string, err error) {
-	jsondata, err := yaml.YAMLToJSON([]byte(yamlString))
-	if err != nil {
-		return nil, err
-	}
-	return GetImageFromJSON(ctx, string(jsondata))
-}
-
 //DockerSecrets docker secrets object
 type DockerSecrets struct {
 	Auths map[string]DockerAuth `json:"auths,omitempty"`
@@ -84,6 +62,34 @@ type DockerAuth struct {
 	Auth     string `json:"auth,omitempty"`
 }
 
+// ManagedSecretLabel label the docker secrets the tool copied to the namespaces, only the secrets with the
+// label are cached outside the source namespace
+const ManagedSecretLabel = "secret-tools.io/managed"
+
+//ManagedSecretSelector the label selector of the docker secrets the tool copied
+func ManagedSecretSelector() string {
+	return ManagedSecretLabel + "=true"
+}
+
+//PropagatedSecret copy the source docker secret to the namespace with the managed label
+func PropagatedSecret(source corev1.Secret, namespace string) *corev1.Secret {
+	var labels = map[string]string{}
+	for key, value := range source.Labels {
+		labels[key] = value
+	}
+	labels[ManagedSecretLabel] = "true"
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        source.Name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: source.Annotations,
+		},
+		Type: source.Type,
+		Data: source.Data,
+	}
+}
+
 //GetDockerSecrets get docker secrets in dockerSecretNames
 func GetDockerSecrets(ctx context.Context, mgrClient client.Client, logger logr.Logger, dockerSecretNames []string) (imageSecrets []*corev1.Secret) {
 	for _, item := range dockerSecretNames {
@@ -99,31 +105,187 @@ func GetDockerSecrets(ctx context.Context, mgrClient client.Client, logger logr.
 		if secret.Type != "kubernetes.io/dockerconfigjson" {
 			continue
 		}
+		metrics.CredentialRefresh.WithLabelValues(secret.Name).Set(float64(lastWriteTime(secret).Unix()))
 		imageSecrets = append(imageSecrets, secret)
 	}
 	return
 }
 
-// GetKubernetesCA get current cluster ca
-func GetKubernetesCA(ctx context.Context, c client.Client) ([]byte, error) {
-	var result []byte
-	secretList := &corev1.SecretList{}
-	err := c.List(ctx, secretList, &client.ListOptions{Namespace: GetCurrentNameSpace()})
-	if err != nil {
-		return nil, err
+//GetSecretAuthRegistry get the docker secrets in dockerSecretNames group by the registry host in the secret auths
+func GetSecretAuthRegistry(ctx context.Context, mgrClient client.Client, logger logr.Logger, dockerSecretNames []string) map[string][]corev1.Secret {
+	var result = map[string][]corev1.Secret{}
+	var secrets = GetDockerSecrets(ctx, mgrClient, logger, dockerSecretNames)
+	for _, item := range secrets {
+		configData, ok := item.Data[".dockerconfigjson"]
+		if ok {
+			var dockerSecrets = &DockerSecrets{}
+			err := json.Unmarshal(configData, dockerSecrets)
+			if err == nil {
+				for key := range dockerSecrets.Auths {
+					result[key] = append(result[key], *item)
+				}
+			} else {
+				logger.Error(err, "unmarshal docker secret to docker config error")
+			}
+		}
+	}
+	return result
+}
+
+//GetImagesSecrets get the docker secrets which can pull the images
+func GetImagesSecrets(ctx context.Context, mgrClient client.Client, logger logr.Logger, dockerSecretNames []string, images []string) []corev1.Secret {
+	var registrySecrets = GetSecretAuthRegistry(ctx, mgrClient, logger, dockerSecretNames)
+	return MatchImagesSecrets(registrySecrets, images)
+}
+
+//MatchImagesSecrets match the images registry host with the secrets group by registry, the secret matched
+// by several images is returned once
+func MatchImagesSecrets(registrySecrets map[string][]corev1.Secret, images []string) []corev1.Secret {
+	var result = []corev1.Secret{}
+	var matched = map[string]bool{}
+	// the registry of each image is looked up in the map, the cost not grow with the number of secrets
+	for _, image := range images {
+		for _, item := range registrySecrets[ImageRegistry(image)] {
+			if !matched[item.Name] {
+				matched[item.Name] = true
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+//SecretOrder the order of the injected secrets, the secrets in priority first and then the other
+// dockerSecretNames. The names in priority not in dockerSecretNames are ignored
+func SecretOrder(priority, dockerSecretNames []string) []string {
+	var result []string
+	for _, item := range priority {
+		if containString(dockerSecretNames, item) && !containString(result, item) {
+			result = append(result, item)
+		}
+	}
+	for _, item := range dockerSecretNames {
+		if !containString(result, item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+//OrderSecrets remove the duplicated secrets and sort them by the index of the name in order, the kubelet
+// try the credentials of the same registry in this order. The secrets not in order are kept at the end
+func OrderSecrets(secrets []corev1.Secret, order []string) []corev1.Secret {
+	var rank = func(name string) int {
+		for index, item := range order {
+			if item == name {
+				return index
+			}
+		}
+		return len(order)
+	}
+	var result []corev1.Secret
+	var names = map[string]bool{}
+	for _, item := range secrets {
+		if !names[item.Name] {
+			names[item.Name] = true
+			result = append(result, item)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return rank(result[i].Name) < rank(result[j].Name)
+	})
+	return result
+}
+
+//ImageRegistry get the registry host of the image, the first path component is used when the image can
+// not be parsed
+func ImageRegistry(image string) string {
+	if reference, err := ParseImageReference(image); err == nil {
+		return reference.Registry
+	}
+	imagePathURLSplits := strings.Split(image, ":")
+	imagePathSplits := strings.Split(imagePathURLSplits[0], "/")
+	return imagePathSplits[0]
+}
+
+//RecordInjectedSecrets count the injected secrets by the registries they are indexed for, the secrets
+// requested by the annotations are counted the same as the secrets matched by the images
+func RecordInjectedSecrets(registrySecrets map[string][]corev1.Secret, secrets []corev1.Secret) {
+	for registry, items := range registrySecrets {
+		for _, item := range items {
+			for _, secret := range secrets {
+				if secret.Name == item.Name {
+					metrics.SecretsInjected.WithLabelValues(registry).Inc()
+					break
+				}
+			}
+		}
+	}
+}
+
+// lastWriteTime the last time the secret was written, the managed fields keep the time of each
+// write, the creation time is used when the managed fields are not set
+func lastWriteTime(secret *corev1.Secret) time.Time {
+	var result = secret.CreationTimestamp.Time
+	for _, item := range secret.ManagedFields {
+		if item.Time != nil && item.Time.After(result) {
+			result = item.Time.Time
+		}
+	}
+	return result
+}
+
+// GetKubernetesCA get current cluster ca, the sources are tried in order: the mounted service account ca.crt,
+// the kube-root-ca.crt configmap, the rest config CA and the legacy service account token secret
+func GetKubernetesCA(ctx context.Context, c client.Client, restConfig *rest.Config) ([]byte, error) {
+	var errs []string
+	data, err := ioutil.ReadFile(serviceAccountCAPath)
+	if err == nil && len(data) > 0 {
+		return data, nil
+	}
+	errs = append(errs, fmt.Sprintf("file %s: %v", serviceAccountCAPath, errOrEmpty(err)))
+
+	var configMap = &corev1.ConfigMap{}
+	err = c.Get(ctx, types.NamespacedName{Namespace: GetCurrentNameSpace(), Name: rootCAConfigMapName}, configMap)
+	if err == nil && configMap.Data[CACertKey] != "" {
+		return []byte(configMap.Data[CACertKey]), nil
 	}
-	for _, item := range secretList.Items {
-		if item.Type == corev1.SecretTypeServiceAccountToken {
-			if value, ok := item.Annotations["kubernetes.io/service-account.name"]; ok && value == "default" {
-				result = item.Data["ca.crt"]
-				return result, nil
+	errs = append(errs, fmt.Sprintf("configmap %s/%s: %v", GetCurrentNameSpace(), rootCAConfigMapName, errOrEmpty(err)))
+
+	if restConfig != nil && len(restConfig.CAData) > 0 {
+		return restConfig.CAData, nil
+	} else if restConfig != nil && restConfig.CAFile != "" {
+		data, err = ioutil.ReadFile(restConfig.CAFile)
+		if err == nil && len(data) > 0 {
+			return data, nil
+		}
+		errs = append(errs, fmt.Sprintf("rest config CA file %s: %v", restConfig.CAFile, errOrEmpty(err)))
+	} else {
+		errs = append(errs, "rest config: no CA data")
+	}
+
+	secretList := &corev1.SecretList{}
+	err = c.List(ctx, secretList, &client.ListOptions{Namespace: GetCurrentNameSpace()})
+	if err == nil {
+		for _, item := range secretList.Items {
+			if item.Type == corev1.SecretTypeServiceAccountToken {
+				if value, ok := item.Annotations["kubernetes.io/service-account.name"]; ok && value == "default" {
+					return item.Data[CACertKey], nil
+				}
 			}
 		}
+		err = errors.New("token not found")
 	}
-	return nil, errors.New("token not found")
+	errs = append(errs, fmt.Sprintf("service account token secret: %v", err))
+	return nil, fmt.Errorf("kubernetes CA not found, tried %s", strings.Join(errs, "; "))
 }
 
-var csrName = "docker-secret-tool-webhook.tool-test"
+func errOrEmpty(err error) error {
+	if err != nil {
+		return err
+	}
+	return errors.New("empty")
+}
 
 //CreateApproveTLSCert create TLS cert with kubernetes Certificate Signing
 // Notice this is not work for the kubernetes not config cert sign config
@@ -135,29 +297,9 @@ func CreateApproveTLSCert(ctx context.Context, restConfig *rest.Config, config *
 	if err == nil {
 		isSupportV1 = true
 	}
-	if isSupportV1 {
-		certClient := kubeClient.CertificatesV1().CertificateSigningRequests()
-		_, err = certClient.Get(ctx, csrName, metav1.GetOptions{})
-		if err != nil && !k8serrors.IsNotFound(err) {
-			return nil, nil, err
-		} else if err == nil {
-			err = certClient.Delete(ctx, csrName, metav1.DeleteOptions{})
-			if err != nil {
-				return nil, nil, err
-			}
-		}
-	} else {
-		certClient := kubeClient.CertificatesV1beta1().CertificateSigningRequests()
-		_, err = certClient.Get(ctx, csrName, metav1.GetOptions{})
-		if err != nil && !k8serrors.IsNotFound(err) {
-			return nil, nil, err
-		} else if err == nil {
-			err = certClient.Delete(ctx, csrName, metav1.DeleteOptions{})
-			if err != nil {
-				return nil, nil, err
-			}
-		}
-	}
+	// the CSR name is unique for each request, so the replicas and the renewals never delete the
+	// request in progress of others
+	var csrName = fmt.Sprintf("%s.%s-%s", config.CertName, GetCurrentNameSpace(), rand.String(5))
 
 	privateKey, certificateRequest, err := CreateCertificateRequest(config)
 	if err != nil {
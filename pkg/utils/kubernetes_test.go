@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestGetKubernetesCA(t *testing.T) {
+	if _, err := os.Stat(serviceAccountCAPath); err == nil {
+		t.Skip("the service account CA is mounted")
+	}
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var ctx = context.TODO()
+
+	_, err := GetKubernetesCA(ctx, fake.NewClientBuilder().WithScheme(scheme).Build(), &rest.Config{})
+	if err == nil {
+		t.Fatal("expect error for no CA source")
+	}
+	for _, source := range []string{serviceAccountCAPath, rootCAConfigMapName, "rest config", "service account token secret"} {
+		if !strings.Contains(err.Error(), source) {
+			t.Fatalf("expect error contains the tried source %s, got %v", source, err)
+		}
+	}
+
+	data, err := GetKubernetesCA(ctx, fake.NewClientBuilder().WithScheme(scheme).Build(), &rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{CAData: []byte("rest-ca")},
+	})
+	if err != nil || string(data) != "rest-ca" {
+		t.Fatalf("expect the rest config CA, got %s %v", data, err)
+	}
+
+	var configMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tool-test", Name: rootCAConfigMapName},
+		Data:       map[string]string{CACertKey: "root-ca"},
+	}
+	data, err = GetKubernetesCA(ctx, fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build(), &rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{CAData: []byte("rest-ca")},
+	})
+	if err != nil || string(data) != "root-ca" {
+		t.Fatalf("expect the root CA configmap, got %s %v", data, err)
+	}
+}
+
+func TestLastWriteTime(t *testing.T) {
+	var created = metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	var secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: created}}
+	if !lastWriteTime(secret).Equal(created.Time) {
+		t.Fatalf("expect the creation time, got %v", lastWriteTime(secret))
+	}
+	var updated = metav1.NewTime(created.Add(30 * time.Minute))
+	secret.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl", Time: &created}, {Manager: "refresher", Time: &updated}}
+	if !lastWriteTime(secret).Equal(updated.Time) {
+		t.Fatalf("expect the last managed fields time, got %v", lastWriteTime(secret))
+	}
+}
+
+func TestSourceSecretsChecker(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tool-test", Name: "registry"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+	}
+	var reader = fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	var req = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	if err := SourceSecretsChecker(reader, zap.New(), []string{"registry"})(req); err != nil {
+		t.Fatal(err)
+	}
+	// the other secrets are still injected when one source secret is missing
+	if err := SourceSecretsChecker(reader, zap.New(), []string{"registry", "missing"})(req); err != nil {
+		t.Fatalf("expect ready with one secret resolved, got %v", err)
+	}
+	if err := SourceSecretsChecker(reader, zap.New(), []string{"missing"})(req); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expect error for the missing secret, got %v", err)
+	}
+}
+
+func TestOrderSecrets(t *testing.T) {
+	var first, second = *newTestDockerSecret("first", "a.registry"), *newTestDockerSecret("second", "a.registry", "b.registry")
+	var registrySecrets = map[string][]corev1.Secret{"a.registry": {first, second}, "b.registry": {second}}
+	var secrets = MatchImagesSecrets(registrySecrets, []string{"b.registry/app:v1", "a.registry/app:v1", "a.registry/other:v1"})
+	var names = func(secrets []corev1.Secret) string {
+		var result []string
+		for _, item := range secrets {
+			result = append(result, item.Name)
+		}
+		return strings.Join(result, ",")
+	}
+	if names(secrets) != "second,first" {
+		t.Fatalf("expect the matched secrets deduplicated, got %s", names(secrets))
+	}
+	var order = SecretOrder([]string{"unknown", "second"}, []string{"first", "second", "third"})
+	if strings.Join(order, ",") != "second,first,third" {
+		t.Fatalf("unexpected order %v", order)
+	}
+	if result := OrderSecrets(append(secrets, first), SecretOrder(nil, []string{"first", "second"})); names(result) != "first,second" {
+		t.Fatalf("expect the secrets in dockerSecretNames order, got %s", names(result))
+	}
+	if result := OrderSecrets(secrets, order); names(result) != "second,first" {
+		t.Fatalf("expect the secrets in priority order, got %s", names(result))
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+)
+
+//RegistryIndex index the source docker secrets by the registry host in the secret auths. The index is
+// updated incrementally from the secret informer events, the readers get an immutable snapshot without lock
+type RegistryIndex struct {
+	log               logr.Logger
+	dockerSecretNames []string
+	// lock serialize the writers, the readers load the snapshot only
+	lock sync.Mutex
+	// registries the registry hosts of each indexed secret
+	registries map[string][]string
+	secrets    map[string]*corev1.Secret
+	// snapshot the map[string][]corev1.Secret from registry host to the secrets, it is replaced on each update
+	snapshot atomic.Value
+}
+
+//NewRegistryIndex create an empty index of the docker secrets in dockerSecretNames
+func NewRegistryIndex(log logr.Logger, dockerSecretNames []string) *RegistryIndex {
+	var index = &RegistryIndex{
+		log:               log,
+		dockerSecretNames: dockerSecretNames,
+		registries:        map[string][]string{},
+		secrets:           map[string]*corev1.Secret{},
+	}
+	index.snapshot.Store(map[string][]corev1.Secret{})
+	return index
+}
+
+//RegistrySecrets the docker secrets group by the registry host, the same as GetSecretAuthRegistry. The
+// result is shared by all the readers and must not be modified
+func (r *RegistryIndex) RegistrySecrets() map[string][]corev1.Secret {
+	return r.snapshot.Load().(map[string][]corev1.Secret)
+}
+
+//Update index the secret, the secret not in dockerSecretNames or not a dockerconfigjson secret is removed
+func (r *RegistryIndex) Update(secret *corev1.Secret) {
+	if !r.watched(secret) {
+		return
+	}
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		r.Delete(secret)
+		return
+	}
+	var registries []string
+	var dockerSecrets = &DockerSecrets{}
+	if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], dockerSecrets); err != nil {
+		r.log.Error(err, "unmarshal docker secret to docker config error", "SecretName", secret.Name)
+	}
+	for key := range dockerSecrets.Auths {
+		registries = append(registries, key)
+	}
+	metrics.CredentialRefresh.WithLabelValues(secret.Name).Set(float64(lastWriteTime(secret).Unix()))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var changed = append(append([]string{}, r.registries[secret.Name]...), registries...)
+	r.registries[secret.Name] = registries
+	r.secrets[secret.Name] = secret.DeepCopy()
+	r.rebuild(changed)
+}
+
+//Delete remove the secret from the index
+func (r *RegistryIndex) Delete(secret *corev1.Secret) {
+	if !r.watched(secret) {
+		return
+	}
+	metrics.CredentialRefresh.DeleteLabelValues(secret.Name)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var changed = r.registries[secret.Name]
+	delete(r.registries, secret.Name)
+	delete(r.secrets, secret.Name)
+	r.rebuild(changed)
+}
+
+// rebuild replace the snapshot with the secrets of the changed registries rebuilt, the secrets of a
+// registry are in the order of dockerSecretNames
+func (r *RegistryIndex) rebuild(changed []string) {
+	var current = r.RegistrySecrets()
+	var snapshot = make(map[string][]corev1.Secret, len(current))
+	for key, value := range current {
+		snapshot[key] = value
+	}
+	for _, registry := range changed {
+		var secrets []corev1.Secret
+		for _, name := range r.dockerSecretNames {
+			if containString(r.registries[name], registry) {
+				secrets = append(secrets, *r.secrets[name])
+			}
+		}
+		if len(secrets) == 0 {
+			delete(snapshot, registry)
+		} else {
+			snapshot[registry] = secrets
+		}
+	}
+	r.snapshot.Store(snapshot)
+}
+
+// watched check the secret is a source docker secret
+func (r *RegistryIndex) watched(secret *corev1.Secret) bool {
+	return secret.Namespace == GetCurrentNameSpace() && containString(r.dockerSecretNames, secret.Name)
+}
+
+//Watch index the secrets from the secret informer of the cache, the informer is shared with the controllers
+func (r *RegistryIndex) Watch(ctx context.Context, informers cache.Informers) error {
+	informer, err := informers.GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return err
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				r.Update(secret)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if secret, ok := newObj.(*corev1.Secret); ok {
+				r.Update(secret)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if secret, ok := obj.(*corev1.Secret); ok {
+				r.Delete(secret)
+			}
+		},
+	})
+	return nil
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func newTestDockerSecret(name string, registries ...string) *corev1.Secret {
+	var auths = map[string]DockerAuth{}
+	for _, item := range registries {
+		auths[item] = DockerAuth{Auth: "dGVzdDp0ZXN0"}
+	}
+	data, _ := json.Marshal(&DockerSecrets{Auths: auths})
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tool-test", Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: data},
+	}
+}
+
+func registrySecretNames(registrySecrets map[string][]corev1.Secret, registry string) []string {
+	var result []string
+	for _, item := range registrySecrets[registry] {
+		result = append(result, item.Name)
+	}
+	return result
+}
+
+func TestRegistryIndex(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var index = NewRegistryIndex(zap.New(), []string{"first", "second"})
+	index.Update(newTestDockerSecret("second", "a.registry", "b.registry"))
+	index.Update(newTestDockerSecret("first", "a.registry"))
+	// the secret not in dockerSecretNames or other namespace is not indexed
+	index.Update(newTestDockerSecret("other", "a.registry"))
+	var otherNamespace = newTestDockerSecret("first", "c.registry")
+	otherNamespace.Namespace = "other"
+	index.Update(otherNamespace)
+
+	var snapshot = index.RegistrySecrets()
+	if names := registrySecretNames(snapshot, "a.registry"); fmt.Sprint(names) != "[first second]" {
+		t.Fatalf("expect the secrets in dockerSecretNames order, got %v", names)
+	}
+	if names := registrySecretNames(snapshot, "b.registry"); fmt.Sprint(names) != "[second]" {
+		t.Fatalf("unexpected b.registry secrets %v", names)
+	}
+	if _, ok := snapshot["c.registry"]; ok {
+		t.Fatal("expect the secret of other namespace not indexed")
+	}
+
+	// the registry removed from the secret is removed from the index, the old snapshot is unchanged
+	index.Update(newTestDockerSecret("second", "a.registry"))
+	if _, ok := index.RegistrySecrets()["b.registry"]; ok {
+		t.Fatal("expect b.registry removed")
+	}
+	if names := registrySecretNames(snapshot, "b.registry"); fmt.Sprint(names) != "[second]" {
+		t.Fatalf("expect the old snapshot unchanged, got %v", names)
+	}
+	index.Delete(newTestDockerSecret("first"))
+	if names := registrySecretNames(index.RegistrySecrets(), "a.registry"); fmt.Sprint(names) != "[second]" {
+		t.Fatalf("expect the deleted secret removed, got %v", names)
+	}
+	var opaque = newTestDockerSecret("second")
+	opaque.Type = corev1.SecretTypeOpaque
+	index.Update(opaque)
+	if len(index.RegistrySecrets()) != 0 {
+		t.Fatalf("expect the opaque secret removed, got %v", index.RegistrySecrets())
+	}
+}
+
+func TestRegistryIndexConcurrent(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var index = NewRegistryIndex(zap.New(), []string{"first", "second"})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				index.Update(newTestDockerSecret([]string{"first", "second"}[j%2], fmt.Sprintf("%d.registry", i)))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				MatchImagesSecrets(index.RegistrySecrets(), []string{"0.registry/library/nginx:latest"})
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkSecrets create the source secrets, each secret has the credential of its own registry
+func benchmarkSecrets(count int) (names []string, objects []client.Object) {
+	for i := 0; i < count; i++ {
+		var name = fmt.Sprintf("secret-%d", i)
+		names = append(names, name)
+		objects = append(objects, newTestDockerSecret(name, fmt.Sprintf("%d.registry", i)))
+	}
+	return names, objects
+}
+
+var benchmarkImages = []string{"0.registry/library/nginx:latest", "docker.io/library/busybox:latest"}
+
+func BenchmarkRegistryIndexMatch(b *testing.B) {
+	b.Setenv("DEBUG_NAMESPACE", "tool-test")
+	for _, count := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("secrets-%d", count), func(b *testing.B) {
+			names, objects := benchmarkSecrets(count)
+			var index = NewRegistryIndex(zap.New(), names)
+			for _, item := range objects {
+				index.Update(item.(*corev1.Secret))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				MatchImagesSecrets(index.RegistrySecrets(), benchmarkImages)
+			}
+		})
+	}
+}
+
+func BenchmarkGetSecretAuthRegistryMatch(b *testing.B) {
+	b.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	for _, count := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("secrets-%d", count), func(b *testing.B) {
+			names, objects := benchmarkSecrets(count)
+			var c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				MatchImagesSecrets(GetSecretAuthRegistry(context.TODO(), c, zap.New(), names), benchmarkImages)
+			}
+		})
+	}
+}
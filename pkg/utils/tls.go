@@ -19,13 +19,13 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"errors"
-	"fmt"
 	v1 "k8s.io/api/core/v1"
 	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"strings"
 )
 
@@ -39,6 +39,11 @@ var (
 	ErrInternal          = errors.New("internal error while generating TLS assets")
 )
 
+const (
+	// CACertKey the key of the CA certificate in the CA configmap
+	CACertKey = "ca.crt"
+)
+
 const (
 	// ClientAndServingCert defines both client and serving cert.
 	ClientAndServingCert CertType = iota
@@ -70,24 +75,45 @@ func GenerateCert(config *CertConfig) (*rsa.PrivateKey, *x509.Certificate, *x509
 		return nil, nil, nil, err
 	}
 	// If no custom CAKey and CACert are provided we have to generate them
-	caKey, err := newPrivateKey()
+	caKey, caCert, err := GenerateCA()
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	caCert, err := newSelfSignedCACertificate(caKey)
+	key, cert, err := GenerateSignedCert(config, caKey, caCert)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	return key, caCert, cert, nil
+
+}
+
+//GenerateCA returns a new self signed CA private key and certificate
+func GenerateCA() (*rsa.PrivateKey, *x509.Certificate, error) {
+	caKey, err := newPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := newSelfSignedCACertificate(caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caKey, caCert, nil
+}
+
+//GenerateSignedCert returns a new private key and the certificate signed by the given CA
+func GenerateSignedCert(config *CertConfig, caKey *rsa.PrivateKey, caCert *x509.Certificate) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if err := verifyConfig(config); err != nil {
+		return nil, nil, err
+	}
 	key, err := newPrivateKey()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 	cert, err := newSignedCertificate(config, key, caCert, caKey)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
-	return key, caCert, cert, nil
-
+	return key, cert, nil
 }
 
 func verifyConfig(config *CertConfig) error {
@@ -110,43 +136,6 @@ func ToCASecretAndConfigMapName(kind, name string) string {
 	return strings.ToLower(kind) + "-" + name + "-ca"
 }
 
-// getCASecretAndConfigMapInCluster gets CA secret and configmap of the given name and namespace.
-// it only returns both if they are found and nil if both are not found. In the case if only one of them is found,
-// then we error out because we expect either both CA secret and configmap exit or not.
-//
-// NOTE: both the CA secret and configmap have the same name with template `<cr-kind>-<cr-name>-ca` which is what the
-// input parameter `name` refers to.
-func getCASecretAndConfigMapInCluster(kubeClient kubernetes.Interface, name,
-	namespace string) (*v1.Secret, *v1.ConfigMap, error) {
-	hasConfigMap := true
-	cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
-	if err != nil && !apiErrors.IsNotFound(err) {
-		return nil, nil, err
-	}
-	if apiErrors.IsNotFound(err) {
-		hasConfigMap = false
-	}
-
-	hasSecret := true
-	se, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
-	if err != nil && !apiErrors.IsNotFound(err) {
-		return nil, nil, err
-	}
-	if apiErrors.IsNotFound(err) {
-		hasSecret = false
-	}
-	if hasConfigMap != hasSecret {
-		// TODO: this case can happen if creating CA configmap succeeds and creating CA secret failed.
-		//  We need to handle this case properly.
-		return nil, nil, fmt.Errorf("expect either both ca configmap and secret both exist or not exist, "+
-			" but got hasCAConfigmap==%v and hasCASecret==%v", hasConfigMap, hasSecret)
-	}
-	if !hasConfigMap {
-		return nil, nil, nil
-	}
-	return se, cm, nil
-}
-
 func toKindNameNamespace(cr runtime.Object) (string, string, string, error) {
 	a := meta.NewAccessor()
 	k, err := a.Kind(cr)
@@ -164,6 +153,18 @@ func toKindNameNamespace(cr runtime.Object) (string, string, string, error) {
 	return k, n, ns, nil
 }
 
+// toCAConfigMap returns the configmap keep the CA certificate.
+func toCAConfigMap(cert *x509.Certificate, name string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Data: map[string]string{
+			CACertKey: string(EncodeCertificatePEM(cert)),
+		},
+	}
+}
+
 // toTLSSecret returns a client/server "kubernetes.io/tls" secret.
 func toTLSSecret(key *rsa.PrivateKey, cert *x509.Certificate, name string) *v1.Secret {
 	return &v1.Secret{
@@ -194,3 +195,87 @@ func CreateCertificateRequest(config *CertConfig) (*rsa.PrivateKey, *x509.Certif
 
 	return caKey, certificateRequest, nil
 }
+
+//SelfSignedCAName the name of the secret and configmap keep the self signed CA of the service
+func SelfSignedCAName(serviceName string) string {
+	return ToCASecretAndConfigMapName("Service", serviceName)
+}
+
+//CreateSelfSignedTLSCert create the TLS cert signed by the self signed CA. The CA is created at the first time and
+// kept in the secret and configmap named by SelfSignedCAName, so all the certs are verified by the same CA bundle
+func CreateSelfSignedTLSCert(ctx context.Context, restConfig *rest.Config, namespace string, config *CertConfig) (privateKeyData []byte, certificateData []byte, err error) {
+	if err = verifyConfig(config); err != nil {
+		return nil, nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, caCert, err := getOrCreateCA(ctx, kubeClient, SelfSignedCAName(config.CertName), namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, cert, err := GenerateSignedCert(config, caKey, caCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	return EncodePrivateKeyPEM(key), EncodeCertificatePEM(cert), nil
+}
+
+// getOrCreateCA get the CA from the secret, a new CA is created when the secret not exist. The configmap is
+// created or fixed from the certificate in the secret, so the CA recover when the configmap create failed before
+func getOrCreateCA(ctx context.Context, kubeClient kubernetes.Interface, name, namespace string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	var caKey *rsa.PrivateKey
+	var caCert *x509.Certificate
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		caKey, err = ParsePEMEncodedPrivateKey(secret.Data[v1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, nil, err
+		}
+		caCert, err = ParsePEMEncodedCert(secret.Data[v1.TLSCertKey])
+		if err != nil {
+			return nil, nil, err
+		}
+	case apiErrors.IsNotFound(err):
+		caKey, caCert, err = GenerateCA()
+		if err != nil {
+			return nil, nil, err
+		}
+		secret = toTLSSecret(caKey, caCert, name)
+		secret.Namespace = namespace
+		_, err = kubeClient.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, err
+	}
+	if err = ensureCAConfigMap(ctx, kubeClient, caCert, name, namespace); err != nil {
+		return nil, nil, err
+	}
+	return caKey, caCert, nil
+}
+
+// ensureCAConfigMap create the CA configmap or update it when the certificate is not the CA certificate
+func ensureCAConfigMap(ctx context.Context, kubeClient kubernetes.Interface, caCert *x509.Certificate, name, namespace string) error {
+	var expect = toCAConfigMap(caCert, name)
+	expect.Namespace = namespace
+	configMap, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		_, err = kubeClient.CoreV1().ConfigMaps(namespace).Create(ctx, expect, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	if configMap.Data[CACertKey] == expect.Data[CACertKey] {
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[CACertKey] = expect.Data[CACertKey]
+	_, err = kubeClient.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
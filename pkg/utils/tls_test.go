@@ -1,9 +1,14 @@
 package utils
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
 	"strings"
 	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestGenerateCert(t *testing.T) {
@@ -58,3 +63,61 @@ func TestInitCommand(t *testing.T) {
 	nslookupCommand = strings.ReplaceAll(nslookupCommand, "{{HOSTS}}", hostDomain)
 	fmt.Print(nslookupCommand)
 }
+
+func TestGetOrCreateCA(t *testing.T) {
+	var kubeClient = fake.NewSimpleClientset()
+	caKey, caCert, err := getOrCreateCA(context.TODO(), kubeClient, SelfSignedCAName("test"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kubeClient.CoreV1().Secrets("test").Get(context.TODO(), "service-test-ca", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expect the CA secret created, got %v", err)
+	}
+	configMap, err := kubeClient.CoreV1().ConfigMaps("test").Get(context.TODO(), "service-test-ca", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expect the CA configmap created, got %v", err)
+	}
+	existKey, existCert, err := getOrCreateCA(context.TODO(), kubeClient, SelfSignedCAName("test"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existCert.Equal(caCert) || !existKey.Equal(caKey) {
+		t.Fatal("expect the exist CA returned")
+	}
+	_, cert, err := GenerateSignedCert(&CertConfig{CertName: "test", CertType: ServingCert, DNSName: []string{"test.test.svc"}},
+		existKey, existCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots = x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(configMap.Data[CACertKey]))
+	if _, err = cert.Verify(x509.VerifyOptions{DNSName: "test.test.svc", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetOrCreateCARecoverConfigMap(t *testing.T) {
+	var kubeClient = fake.NewSimpleClientset()
+	_, caCert, err := getOrCreateCA(context.TODO(), kubeClient, SelfSignedCAName("test"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the configmap create failed after the secret created
+	if err = kubeClient.CoreV1().ConfigMaps("test").Delete(context.TODO(), "service-test-ca", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, existCert, err := getOrCreateCA(context.TODO(), kubeClient, SelfSignedCAName("test"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existCert.Equal(caCert) {
+		t.Fatal("expect the CA in the secret kept")
+	}
+	configMap, err := kubeClient.CoreV1().ConfigMaps("test").Get(context.TODO(), "service-test-ca", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configMap.Data[CACertKey] != string(EncodeCertificatePEM(caCert)) {
+		t.Fatal("expect the configmap recreated with the CA certificate")
+	}
+}
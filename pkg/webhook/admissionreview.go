@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// defaultAdmissionReviewGVK the version used when the request body not set apiVersion and kind
+var defaultAdmissionReviewGVK = v1.SchemeGroupVersion.WithKind("AdmissionReview")
+
+func init() {
+	utilruntime.Must(v1.AddToScheme(runtimeScheme))
+	utilruntime.Must(v1beta1.AddToScheme(runtimeScheme))
+}
+
+//decodeAdmissionReview decode the admission review of v1 or v1beta1, the v1beta1 request is converted to v1
+// and the returned gvk is the version the response must be answered with
+func decodeAdmissionReview(body []byte) (*v1.AdmissionReview, *schema.GroupVersionKind, error) {
+	object, gvk, err := deserializer.Decode(body, &defaultAdmissionReviewGVK, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch review := object.(type) {
+	case *v1.AdmissionReview:
+		return review, gvk, nil
+	case *v1beta1.AdmissionReview:
+		var result = &v1.AdmissionReview{}
+		if review.Request != nil {
+			result.Request = convertV1beta1Request(review.Request)
+		}
+		return result, gvk, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported admission review %s", gvk.String())
+	}
+}
+
+//encodeAdmissionReview build the admission review response in the version of the request
+func encodeAdmissionReview(gvk schema.GroupVersionKind, response *v1.AdmissionResponse) runtime.Object {
+	if gvk.GroupVersion() == v1beta1.SchemeGroupVersion {
+		var review = &v1beta1.AdmissionReview{}
+		review.SetGroupVersionKind(gvk)
+		if response != nil {
+			review.Response = convertV1Response(response)
+		}
+		return review
+	}
+	var review = &v1.AdmissionReview{}
+	review.SetGroupVersionKind(defaultAdmissionReviewGVK)
+	review.Response = response
+	return review
+}
+
+func convertV1beta1Request(request *v1beta1.AdmissionRequest) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:                request.UID,
+		Kind:               request.Kind,
+		Resource:           request.Resource,
+		SubResource:        request.SubResource,
+		RequestKind:        request.RequestKind,
+		RequestResource:    request.RequestResource,
+		RequestSubResource: request.RequestSubResource,
+		Name:               request.Name,
+		Namespace:          request.Namespace,
+		Operation:          v1.Operation(request.Operation),
+		UserInfo:           request.UserInfo,
+		Object:             request.Object,
+		OldObject:          request.OldObject,
+		DryRun:             request.DryRun,
+		Options:            request.Options,
+	}
+}
+
+func convertV1Response(response *v1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	var result = &v1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+	if response.PatchType != nil {
+		var patchType = v1beta1.PatchType(*response.PatchType)
+		result.PatchType = &patchType
+	}
+	return result
+}
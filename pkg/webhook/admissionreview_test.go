@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+func serveAdmissionReview(t *testing.T, server *Server, review interface{}) []byte {
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request = httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	var recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	return recorder.Body.Bytes()
+}
+
+func testDeploymentRaw(t *testing.T) runtime.RawExtension {
+	original, err := yaml.YAMLToJSON([]byte(testyaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: original}
+}
+
+func Test_AdmissionReviewV1(t *testing.T) {
+	var server = newTestServer(t)
+	var review = &v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &v1.AdmissionRequest{
+			UID:       "v1-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: "test1",
+			Operation: v1.Create,
+			Object:    testDeploymentRaw(t),
+		},
+	}
+	var response = &v1.AdmissionReview{}
+	if err := json.Unmarshal(serveAdmissionReview(t, server, review), response); err != nil {
+		t.Fatal(err)
+	}
+	if response.APIVersion != "admission.k8s.io/v1" || response.Kind != "AdmissionReview" {
+		t.Fatalf("unexpected response version %s %s", response.APIVersion, response.Kind)
+	}
+	if response.Response == nil || response.Response.UID != "v1-uid" || !response.Response.Allowed {
+		t.Fatalf("unexpected response %v", response.Response)
+	}
+	if len(response.Response.Patch) == 0 || response.Response.PatchType == nil ||
+		*response.Response.PatchType != v1.PatchTypeJSONPatch {
+		t.Fatalf("expect json patch, got %v", response.Response)
+	}
+}
+
+func Test_AdmissionReviewV1beta1(t *testing.T) {
+	var server = newTestServer(t)
+	var dryRun = true
+	var review = &v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "v1beta1-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: "test1",
+			Operation: v1beta1.Create,
+			Object:    testDeploymentRaw(t),
+			DryRun:    &dryRun,
+		},
+	}
+	var response = &v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(serveAdmissionReview(t, server, review), response); err != nil {
+		t.Fatal(err)
+	}
+	if response.APIVersion != "admission.k8s.io/v1beta1" || response.Kind != "AdmissionReview" {
+		t.Fatalf("unexpected response version %s %s", response.APIVersion, response.Kind)
+	}
+	if response.Response == nil || response.Response.UID != "v1beta1-uid" || !response.Response.Allowed {
+		t.Fatalf("unexpected response %v", response.Response)
+	}
+	if len(response.Response.Patch) == 0 || response.Response.PatchType == nil ||
+		*response.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+		t.Fatalf("expect json patch, got %v", response.Response)
+	}
+}
+
+func Test_AdmissionReviewInvalid(t *testing.T) {
+	var server = newTestServer(t)
+	var response = &v1.AdmissionReview{}
+	var review = map[string]interface{}{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview"}
+	if err := json.Unmarshal(serveAdmissionReview(t, server, review), response); err != nil {
+		t.Fatal(err)
+	}
+	if response.APIVersion != "admission.k8s.io/v1" || response.Response == nil ||
+		response.Response.Allowed || response.Response.Result == nil {
+		t.Fatalf("expect v1 error response, got %v", response)
+	}
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+const (
+	// TLSSecretName the secret keep the serving certificate of the auto TLS mode
+	TLSSecretName = mutatingWebhookConfigurationName
+
+	// certCheckInterval the interval to check the serving certificate expiry and the mounted files
+	certCheckInterval = time.Hour
+	// certReloadInterval the interval to load the serving certificate renewed by the leader from the secret
+	certReloadInterval = time.Minute
+	// certRetryInterval the interval to check the serving certificate when it not loaded or issued
+	certRetryInterval = 10 * time.Second
+)
+
+//certificateStore keep the serving certificate, the certificate can be replaced without restart the server
+type certificateStore struct {
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	certPEM     []byte
+}
+
+//GetCertificate return the current certificate for tls.Config
+func (c *certificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.certificate == nil {
+		return nil, errors.New("serving certificate not loaded")
+	}
+	return c.certificate, nil
+}
+
+//Set parse the pem encoded certificate and key and replace the current certificate
+func (c *certificateStore) Set(certPEM, keyPEM []byte) error {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.certificate = &certificate
+	c.certPEM = certPEM
+	metrics.CertificateExpiry.Set(float64(certificate.Leaf.NotAfter.Unix()))
+	return nil
+}
+
+//NotAfter the expiry time of the current certificate, zero time when no certificate loaded
+func (c *certificateStore) NotAfter() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.certificate == nil {
+		return time.Time{}
+	}
+	return c.certificate.Leaf.NotAfter
+}
+
+//Loaded check the pem encoded certificate is the current certificate
+func (c *certificateStore) Loaded(certPEM []byte) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return bytes.Equal(c.certPEM, certPEM)
+}
+
+// loadCertificate load the serving certificate from the secret periodically until the context is done
+func (s *Server) loadCertificate(ctx context.Context) {
+	for {
+		if err := s.loadCertificateSecret(ctx); err != nil {
+			s.log.Error(err, "load serving certificate error")
+		}
+		// the certificate may not be issued at start
+		var interval = certReloadInterval
+		if s.certificates.NotAfter().IsZero() {
+			interval = certRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// loadCertificateSecret load the certificate from the secret issued by the CertificateRotator or cert-manager
+func (s *Server) loadCertificateSecret(ctx context.Context) error {
+	var secretName = TLSSecretName
+	if s.certManager {
+		name, err := certificateSecretName(ctx, s.client, s.certificateName)
+		if err != nil {
+			return err
+		}
+		secretName = name
+	}
+	var secret = &corev1.Secret{}
+	err := s.client.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(), Name: secretName}, secret)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	} else if k8serrors.IsNotFound(err) {
+		return fmt.Errorf("serving certificate secret %s not issued yet", secretName)
+	}
+	if s.certificates.Loaded(secret.Data[corev1.TLSCertKey]) {
+		return nil
+	}
+	err = s.certificates.Set(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("load serving certificate from secret %s error: %w", secretName, err)
+	}
+	s.log.Info("load serving certificate from secret", "Secret", secretName, "NotAfter", s.certificates.NotAfter())
+	return nil
+}
+
+// watchCertificateFiles reload the mounted certificate files when they changed until the context is done. The
+// directories are watched because the mounted secret files are replaced by the symlink swap
+func (s *Server) watchCertificateFiles(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.Error(err, "create certificate files watcher error, the files are reloaded periodically")
+	} else {
+		defer watcher.Close()
+		for _, dir := range []string{filepath.Dir(s.certFile), filepath.Dir(s.privateKeyFile)} {
+			if err = watcher.Add(dir); err != nil {
+				s.log.Error(err, "watch certificate files error", "Dir", dir)
+			}
+		}
+	}
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+	var ticker = time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err = <-errs:
+			s.log.Error(err, "watch certificate files error")
+			continue
+		case <-events:
+		case <-ticker.C:
+		}
+		if err = s.loadCertificateFiles(); err != nil {
+			s.log.Error(err, "reload certificate files error, keep serving the current certificate")
+		}
+	}
+}
+
+// loadCertificateFiles load the certificate files, the current certificate is kept when the
+// key not match the certificate
+func (s *Server) loadCertificateFiles() error {
+	cert, err := ioutil.ReadFile(s.certFile)
+	if err != nil {
+		return err
+	}
+	if s.certificates.Loaded(cert) {
+		return nil
+	}
+	privateKey, err := ioutil.ReadFile(s.privateKeyFile)
+	if err != nil {
+		return err
+	}
+	if err = s.certificates.Set(cert, privateKey); err != nil {
+		return err
+	}
+	s.log.Info("load serving certificate from files", "CertFile", s.certFile, "NotAfter", s.certificates.NotAfter())
+	return nil
+}
+
+// serviceDNSNames the DNS names of the webhook service
+func serviceDNSNames(serviceName string) []string {
+	var currentNamespace = utils.GetCurrentNameSpace()
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, currentNamespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, currentNamespace),
+		fmt.Sprintf("%s.%s.svc.cluster", serviceName, currentNamespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, currentNamespace),
+	}
+}
+
+// tlsSecret the secret keep the serving certificate
+func tlsSecret(privateKey, cert []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TLSSecretName,
+			Namespace: utils.GetCurrentNameSpace(),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSPrivateKeyKey: privateKey,
+			corev1.TLSCertKey:       cert,
+		},
+	}
+}
@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+func newTestCertificate(t *testing.T) (privateKey []byte, cert []byte) {
+	key, _, certificate, err := utils.GenerateCert(&utils.CertConfig{
+		CertName: "docker-secret-tool-webhook",
+		CertType: utils.ServingCert,
+		DNSName:  []string{"docker-secret-tool-webhook.tool-test.svc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return utils.EncodePrivateKeyPEM(key), utils.EncodeCertificatePEM(certificate)
+}
+
+func Test_CertificateStore(t *testing.T) {
+	var store = &certificateStore{}
+	if _, err := store.GetCertificate(nil); err == nil {
+		t.Fatal("expect error for no certificate loaded")
+	}
+	privateKey, cert := newTestCertificate(t)
+	if err := store.Set(cert, []byte("broken")); err == nil {
+		t.Fatal("expect error for broken private key")
+	}
+	if err := store.Set(cert, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := store.GetCertificate(nil)
+	if err != nil || certificate.Leaf == nil {
+		t.Fatalf("unexpected certificate %v %v", certificate, err)
+	}
+	if !store.Loaded(cert) || store.NotAfter() != certificate.Leaf.NotAfter {
+		t.Fatal("unexpected loaded certificate")
+	}
+}
+
+func Test_CertificateRotator(t *testing.T) {
+	var server = newTestServer(t)
+	var issued = 0
+	var rotator = &CertificateRotator{
+		client:      server.client,
+		log:         server.log,
+		renewBefore: time.Hour,
+		issueCertificate: func(ctx context.Context) ([]byte, []byte, error) {
+			issued++
+			privateKey, cert := newTestCertificate(t)
+			return privateKey, cert, nil
+		},
+	}
+	var ctx = context.TODO()
+	var key = types.NamespacedName{Namespace: "tool-test", Name: TLSSecretName}
+
+	// the secret is created with a new certificate at the first time
+	if err := rotator.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var secret = &corev1.Secret{}
+	if err := server.client.Get(ctx, key, secret); err != nil {
+		t.Fatal(err)
+	}
+	var cert = secret.Data[corev1.TLSCertKey]
+	if issued != 1 || len(cert) == 0 {
+		t.Fatalf("expect the certificate created, issued %d", issued)
+	}
+
+	// the valid certificate is kept
+	if err := rotator.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if issued != 1 {
+		t.Fatalf("expect the certificate kept, issued %d", issued)
+	}
+
+	// the certificate expires within the renew duration is renewed
+	certificate, err := utils.ParsePEMEncodedCert(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.renewBefore = time.Until(certificate.NotAfter) + time.Hour
+	if err := rotator.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	secret = &corev1.Secret{}
+	if err := server.client.Get(ctx, key, secret); err != nil {
+		t.Fatal(err)
+	}
+	if issued != 2 || string(secret.Data[corev1.TLSCertKey]) == string(cert) {
+		t.Fatalf("expect the certificate renewed, issued %d", issued)
+	}
+}
+
+func Test_LoadCertificateSecret(t *testing.T) {
+	var server = newTestServer(t)
+	server.certificates = &certificateStore{}
+	var ctx = context.TODO()
+	if err := server.loadCertificateSecret(ctx); err == nil {
+		t.Fatal("expect error for the secret not issued")
+	}
+	privateKey, cert := newTestCertificate(t)
+	var secret = tlsSecret(privateKey, cert)
+	if err := server.client.Create(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.loadCertificateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !server.certificates.Loaded(cert) {
+		t.Fatal("expect the secret certificate loaded")
+	}
+
+	// the certificate renewed by the leader is loaded
+	privateKey, cert = newTestCertificate(t)
+	secret.Data = map[string][]byte{corev1.TLSPrivateKeyKey: privateKey, corev1.TLSCertKey: cert}
+	if err := server.client.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.loadCertificateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !server.certificates.Loaded(cert) {
+		t.Fatal("expect the renewed certificate loaded")
+	}
+}
+
+func Test_WatchCertificateFiles(t *testing.T) {
+	var dir = t.TempDir()
+	var server = newTestServer(t)
+	server.certificates = &certificateStore{}
+	server.certFile = filepath.Join(dir, corev1.TLSCertKey)
+	server.privateKeyFile = filepath.Join(dir, corev1.TLSPrivateKeyKey)
+	var writeFiles = func(privateKey, cert []byte) {
+		if err := ioutil.WriteFile(server.privateKeyFile, privateKey, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(server.certFile, cert, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	privateKey, cert := newTestCertificate(t)
+	writeFiles(privateKey, cert)
+	if err := server.loadCertificateFiles(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go server.watchCertificateFiles(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	// the key not match the certificate is not loaded
+	_, otherCert := newTestCertificate(t)
+	if err := ioutil.WriteFile(server.certFile, otherCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !server.certificates.Loaded(cert) {
+		t.Fatal("expect the current certificate kept for the mismatch key")
+	}
+
+	newPrivateKey, newCert := newTestCertificate(t)
+	writeFiles(newPrivateKey, newCert)
+	for i := 0; i < 50 && !server.certificates.Loaded(newCert); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !server.certificates.Loaded(newCert) {
+		t.Fatal("expect the rotated certificate loaded")
+	}
+}
+
+func Test_LoadCertManagerCertificate(t *testing.T) {
+	var server = newTestServer(t)
+	var serverConfig = &config.Config{ServiceName: "docker-secret-tool-webhook", AutoTLS: true,
+		AutoTLSMode: config.AutoTLSModeCertManager, CertManagerIssuerName: "selfsigned"}
+	server.certificates = &certificateStore{}
+	server.certManager = true
+	server.certificateName = CertManagerCertificateName(serverConfig)
+	var ctx = context.TODO()
+	if err := server.loadCertificateSecret(ctx); err == nil {
+		t.Fatal("expect error for the certificate not exist")
+	}
+	var certificate = RenderCertificate(serverConfig)
+	if secretName, _, _ := unstructured.NestedString(certificate.Object, "spec", "secretName"); secretName != CertManagerSecretName {
+		t.Fatalf("expect the certificate issued to %s, got %s", CertManagerSecretName, secretName)
+	}
+	if err := unstructured.SetNestedField(certificate.Object, "issued-tls", "spec", "secretName"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.client.Create(ctx, certificate); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.loadCertificateSecret(ctx); err == nil {
+		t.Fatal("expect error for the secret not issued")
+	}
+	privateKey, cert := newTestCertificate(t)
+	var secret = tlsSecret(privateKey, cert)
+	secret.Name = "issued-tls"
+	if err := server.client.Create(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.loadCertificateSecret(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !server.certificates.Loaded(cert) {
+		t.Fatal("expect the cert-manager certificate loaded")
+	}
+}
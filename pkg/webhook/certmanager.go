@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+const (
+	// CertManagerInjectAnnotation the annotation cert-manager inject the CA of the Certificate to the webhook CABundle
+	CertManagerInjectAnnotation = "cert-manager.io/inject-ca-from"
+
+	// CertManagerSecretName the secret the created cert-manager Certificate issued to, it is not TLSSecretName
+	// so cert-manager and the CertificateRotator never write the same secret
+	CertManagerSecretName = TLSSecretName + "-cert-manager"
+
+	defaultCertManagerIssuerKind = "Issuer"
+)
+
+// certificateGVK the cert-manager Certificate, the cert-manager types are used as unstructured so the
+// tool not depend on the cert-manager api
+var certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+//CertManagerEnabled check the serving certificate is issued by cert-manager
+func CertManagerEnabled(serverConfig *config.Config) bool {
+	return serverConfig.AutoTLS && serverConfig.AutoTLSMode == config.AutoTLSModeCertManager
+}
+
+//CertManagerCertificateName the name of the cert-manager Certificate of the serving certificate
+func CertManagerCertificateName(serverConfig *config.Config) string {
+	if serverConfig.CertManagerCertificate != "" {
+		return serverConfig.CertManagerCertificate
+	}
+	return serverConfig.ServiceName
+}
+
+//RenderCertificate render the cert-manager Certificate of the webhook service
+func RenderCertificate(serverConfig *config.Config) *unstructured.Unstructured {
+	var issuerKind = serverConfig.CertManagerIssuerKind
+	if issuerKind == "" {
+		issuerKind = defaultCertManagerIssuerKind
+	}
+	var dnsNames []interface{}
+	for _, item := range serviceDNSNames(serverConfig.ServiceName) {
+		dnsNames = append(dnsNames, item)
+	}
+	var certificate = &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"secretName": CertManagerSecretName,
+				"commonName": fmt.Sprintf("%s.%s.svc", serverConfig.ServiceName, utils.GetCurrentNameSpace()),
+				"dnsNames":   dnsNames,
+				"issuerRef": map[string]interface{}{
+					"group": certificateGVK.Group,
+					"kind":  issuerKind,
+					"name":  serverConfig.CertManagerIssuerName,
+				},
+			},
+		},
+	}
+	certificate.SetGroupVersionKind(certificateGVK)
+	certificate.SetName(CertManagerCertificateName(serverConfig))
+	certificate.SetNamespace(utils.GetCurrentNameSpace())
+	return certificate
+}
+
+//EnsureCertificate create the cert-manager Certificate when it not exist, the exist Certificate
+// is consumed as it is
+func EnsureCertificate(ctx context.Context, c client.Client, serverConfig *config.Config) error {
+	var certificate = &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	err := c.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(),
+		Name: CertManagerCertificateName(serverConfig)}, certificate)
+	if err == nil || !k8serrors.IsNotFound(err) {
+		return err
+	}
+	if serverConfig.CertManagerIssuerName == "" {
+		return fmt.Errorf("cert-manager certificate %s not found and no issuer configured to create it",
+			CertManagerCertificateName(serverConfig))
+	}
+	return c.Create(ctx, RenderCertificate(serverConfig))
+}
+
+// certificateSecretName get the secret name the cert-manager Certificate issued to
+func certificateSecretName(ctx context.Context, c client.Client, certificateName string) (string, error) {
+	var certificate = &unstructured.Unstructured{}
+	certificate.SetGroupVersionKind(certificateGVK)
+	err := c.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(), Name: certificateName}, certificate)
+	if err != nil {
+		return "", err
+	}
+	secretName, _, err := unstructured.NestedString(certificate.Object, "spec", "secretName")
+	if err != nil {
+		return "", err
+	}
+	if secretName == "" {
+		return "", fmt.Errorf("cert-manager certificate %s not set secretName", certificateName)
+	}
+	return secretName, nil
+}
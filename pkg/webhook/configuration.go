@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+const (
+	// ConfigurationName the name of the MutatingWebhookConfiguration managed by the tool
+	ConfigurationName = mutatingWebhookName
+
+	// InjectLabel the label on namespaces and objects to opt out or opt in the mutating webhook
+	InjectLabel = "secret-tools.io/inject"
+	// InjectDisabled the InjectLabel value the namespaces and objects opt out the mutating webhook
+	InjectDisabled = "disabled"
+	// InjectEnabled the InjectLabel value the namespaces and objects opt in the mutating webhook
+	InjectEnabled = "enabled"
+	// namespaceNameLabel the label set to all namespaces by the api server since kubernetes 1.21
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+
+	mutatingPath                = "/mutate"
+	servicePort           int32 = 443
+	defaultTimeoutSeconds int32 = 10
+)
+
+//RenderMutatingWebhookConfiguration render the desired MutatingWebhookConfiguration from the config. All the
+// fields the api server defaults are set, so the rendered webhooks can be compared with the ones in cluster
+func RenderMutatingWebhookConfiguration(serverConfig *config.Config, caBundle []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	var scope = admissionregistrationv1.AllScopes
+	var path = mutatingPath
+	var port = servicePort
+	// the empty values use the defaults of the api server, except the failure policy which is Ignore
+	// so the workloads can be created when the tool is down
+	var timeoutSeconds = defaultTimeoutSeconds
+	if serverConfig.WebhookTimeoutSeconds > 0 {
+		timeoutSeconds = serverConfig.WebhookTimeoutSeconds
+	}
+	var failurePolicy = admissionregistrationv1.Ignore
+	if serverConfig.WebhookFailurePolicy != "" {
+		failurePolicy = serverConfig.WebhookFailurePolicy
+	}
+	var matchPolicy = admissionregistrationv1.Equivalent
+	if serverConfig.WebhookMatchPolicy != "" {
+		matchPolicy = serverConfig.WebhookMatchPolicy
+	}
+	var reinvocationPolicy = admissionregistrationv1.NeverReinvocationPolicy
+	if serverConfig.WebhookReinvocationPolicy != "" {
+		reinvocationPolicy = serverConfig.WebhookReinvocationPolicy
+	}
+	// the webhook namespace is excluded so the tool pods can always be created
+	var namespaceSelector = injectSelector(serverConfig.WebhookNamespaceSelector, serverConfig.WebhookOptIn,
+		metav1.LabelSelectorRequirement{
+			Key:      namespaceNameLabel,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{utils.GetCurrentNameSpace()},
+		})
+	var objectSelector = injectSelector(serverConfig.WebhookObjectSelector, serverConfig.WebhookOptIn)
+	// the image secrets are created asynchronously for the request which not dry run
+	var sideEffects = admissionregistrationv1.SideEffectClassNoneOnDryRun
+	var annotations map[string]string
+	if CertManagerEnabled(serverConfig) {
+		annotations = map[string]string{
+			CertManagerInjectAnnotation: fmt.Sprintf("%s/%s", utils.GetCurrentNameSpace(), CertManagerCertificateName(serverConfig)),
+		}
+	}
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ConfigurationName,
+			Annotations: annotations,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: configName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Namespace: utils.GetCurrentNameSpace(),
+						Name:      serverConfig.ServiceName,
+						Path:      &path,
+						Port:      &port,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{
+							admissionregistrationv1.Create,
+							admissionregistrationv1.Update,
+						},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"", "apps"},
+							APIVersions: []string{"*"},
+							Resources: []string{
+								"deployments",
+								"daemonsets",
+								"replicasets",
+								"pods",
+							},
+							Scope: &scope,
+						},
+					},
+				},
+				FailurePolicy:           &failurePolicy,
+				MatchPolicy:             &matchPolicy,
+				NamespaceSelector:       namespaceSelector,
+				ObjectSelector:          objectSelector,
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ReinvocationPolicy:      &reinvocationPolicy,
+			},
+		},
+	}
+}
+
+// injectSelector add the opt-out or opt-in requirement and the extra requirements to the selector from config
+func injectSelector(selector *metav1.LabelSelector, optIn bool, requirements ...metav1.LabelSelectorRequirement) *metav1.LabelSelector {
+	var result = &metav1.LabelSelector{}
+	if selector != nil {
+		result = selector.DeepCopy()
+	}
+	if optIn {
+		requirements = append(requirements, metav1.LabelSelectorRequirement{
+			Key:      InjectLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{InjectEnabled},
+		})
+	} else {
+		requirements = append(requirements, metav1.LabelSelectorRequirement{
+			Key:      InjectLabel,
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   []string{InjectDisabled},
+		})
+	}
+	result.MatchExpressions = append(result.MatchExpressions, requirements...)
+	return result
+}
+
+//CABundle get the CA bundle the api server use to verify the webhook server cert. The auto TLS cert is signed
+// by the kubernetes CA or the self signed CA, the mounted cert is verified with the rootCA file
+func CABundle(ctx context.Context, c client.Client, restConfig *rest.Config, serverConfig *config.Config) ([]byte, error) {
+	if CertManagerEnabled(serverConfig) {
+		// the CA bundle is injected by cert-manager
+		return nil, nil
+	}
+	if serverConfig.AutoTLS && serverConfig.AutoTLSMode == config.AutoTLSModeSelfSignedCA {
+		var configMap = &corev1.ConfigMap{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(),
+			Name: utils.SelfSignedCAName(serverConfig.ServiceName)}, configMap)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(configMap.Data[utils.CACertKey]), nil
+	}
+	if serverConfig.AutoTLS {
+		return utils.GetKubernetesCA(ctx, c, restConfig)
+	}
+	if serverConfig.RootCA == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(serverConfig.RootCA)
+}
@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+)
+
+func Test_RenderMutatingWebhookConfiguration(t *testing.T) {
+	var defaultWebhook = RenderMutatingWebhookConfiguration(&config.Config{ServiceName: "webhook"}, nil).Webhooks[0]
+	if *defaultWebhook.FailurePolicy != admissionregistrationv1.Ignore || *defaultWebhook.TimeoutSeconds != 10 ||
+		*defaultWebhook.ReinvocationPolicy != admissionregistrationv1.NeverReinvocationPolicy ||
+		*defaultWebhook.MatchPolicy != admissionregistrationv1.Equivalent {
+		t.Fatalf("unexpected default webhook %v", defaultWebhook)
+	}
+
+	var webhook = RenderMutatingWebhookConfiguration(&config.Config{
+		ServiceName:               "webhook",
+		WebhookFailurePolicy:      admissionregistrationv1.Fail,
+		WebhookTimeoutSeconds:     5,
+		WebhookReinvocationPolicy: admissionregistrationv1.IfNeededReinvocationPolicy,
+		WebhookMatchPolicy:        admissionregistrationv1.Exact,
+	}, nil).Webhooks[0]
+	if *webhook.FailurePolicy != admissionregistrationv1.Fail || *webhook.TimeoutSeconds != 5 ||
+		*webhook.ReinvocationPolicy != admissionregistrationv1.IfNeededReinvocationPolicy ||
+		*webhook.MatchPolicy != admissionregistrationv1.Exact {
+		t.Fatalf("unexpected webhook %v", webhook)
+	}
+}
+
+func Test_RenderWebhookSelectors(t *testing.T) {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var webhook = RenderMutatingWebhookConfiguration(&config.Config{
+		ServiceName:              "webhook",
+		WebhookNamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+	}, nil).Webhooks[0]
+	var namespaces = []struct {
+		labels map[string]string
+		match  bool
+	}{
+		{labels: map[string]string{"team": "a"}, match: true},
+		{labels: map[string]string{"team": "b"}, match: false},
+		{labels: map[string]string{"team": "a", InjectLabel: InjectDisabled}, match: false},
+		{labels: map[string]string{"team": "a", namespaceNameLabel: "tool-test"}, match: false},
+	}
+	for _, item := range namespaces {
+		if match := selectorMatch(t, webhook.NamespaceSelector, item.labels); match != item.match {
+			t.Fatalf("namespace %v expect match %v, got %v", item.labels, item.match, match)
+		}
+	}
+	if selectorMatch(t, webhook.ObjectSelector, map[string]string{InjectLabel: InjectDisabled}) ||
+		!selectorMatch(t, webhook.ObjectSelector, nil) {
+		t.Fatalf("unexpected object selector %v", webhook.ObjectSelector)
+	}
+
+	webhook = RenderMutatingWebhookConfiguration(&config.Config{ServiceName: "webhook", WebhookOptIn: true}, nil).Webhooks[0]
+	if selectorMatch(t, webhook.ObjectSelector, nil) ||
+		!selectorMatch(t, webhook.ObjectSelector, map[string]string{InjectLabel: InjectEnabled}) {
+		t.Fatalf("unexpected opt in object selector %v", webhook.ObjectSelector)
+	}
+}
+
+func selectorMatch(t *testing.T, labelSelector *metav1.LabelSelector, objectLabels map[string]string) bool {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return selector.Matches(labels.Set(objectLabels))
+}
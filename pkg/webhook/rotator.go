@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
+)
+
+//CertificateRotator issue the auto TLS serving certificate to the secret and renew it before expiry. It runs on
+// the leader only, so the replicas never race to create the secret and the CSR
+type CertificateRotator struct {
+	client      client.Client
+	log         logr.Logger
+	restConfig  *rest.Config
+	serviceName string
+	renewBefore time.Duration
+	// issueCertificate create a new serving certificate
+	issueCertificate func(ctx context.Context) (privateKey []byte, cert []byte, err error)
+}
+
+//NewCertificateRotator create the rotator issue the certificate with the auto TLS mode of the config
+func NewCertificateRotator(mgr ctrl.Manager, serverConfig *config.Config) *CertificateRotator {
+	var rotator = &CertificateRotator{
+		client:      mgr.GetClient(),
+		log:         mgr.GetLogger().WithName("certificate-rotator"),
+		restConfig:  mgr.GetConfig(),
+		serviceName: serverConfig.ServiceName,
+		renewBefore: serverConfig.CertRenewBefore,
+	}
+	rotator.issueCertificate = rotator.newServingCertificate
+	if serverConfig.AutoTLSMode == config.AutoTLSModeSelfSignedCA {
+		rotator.issueCertificate = rotator.newSelfSignedServingCertificate
+	}
+	return rotator
+}
+
+//Start check the serving certificate periodically until the context is done
+func (r *CertificateRotator) Start(ctx context.Context) error {
+	for {
+		var interval = certCheckInterval
+		if err := r.rotate(ctx); err != nil {
+			r.log.Error(err, "rotate serving certificate error")
+			interval = certRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+//NeedLeaderElection the certificate is issued by the leader only
+func (r *CertificateRotator) NeedLeaderElection() bool {
+	return true
+}
+
+// rotate create the secret with a new certificate when it not exist, and renew the certificate
+// which expires within the renew duration or can not be parsed
+func (r *CertificateRotator) rotate(ctx context.Context) error {
+	var secret = &corev1.Secret{}
+	err := r.client.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(), Name: TLSSecretName}, secret)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	} else if k8serrors.IsNotFound(err) {
+		r.log.Info("issue the serving certificate", "Secret", TLSSecretName)
+		privateKey, cert, err := r.issueCertificate(ctx)
+		if err != nil {
+			return fmt.Errorf("issue serving certificate error: %w", err)
+		}
+		err = r.client.Create(ctx, tlsSecret(privateKey, cert))
+		if k8serrors.IsAlreadyExists(err) {
+			// the secret is created by the previous leader, check it at the next time
+			return nil
+		}
+		return err
+	}
+	certificate, err := utils.ParsePEMEncodedCert(secret.Data[corev1.TLSCertKey])
+	if err == nil && time.Now().Add(r.renewBefore).Before(certificate.NotAfter) {
+		return nil
+	}
+	if err != nil {
+		r.log.Error(err, "parse serving certificate error, issue a new one", "Secret", TLSSecretName)
+	} else {
+		r.log.Info("renew the serving certificate", "NotAfter", certificate.NotAfter)
+	}
+	privateKey, cert, err := r.issueCertificate(ctx)
+	if err != nil {
+		return fmt.Errorf("renew serving certificate error: %w", err)
+	}
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		corev1.TLSPrivateKeyKey: privateKey,
+		corev1.TLSCertKey:       cert,
+	}
+	return r.client.Update(ctx, secret)
+}
+
+// newServingCertificate request the serving certificate signed by the kubernetes CA
+func (r *CertificateRotator) newServingCertificate(ctx context.Context) (privateKey []byte, cert []byte, err error) {
+	return utils.CreateApproveTLSCert(ctx, r.restConfig, servingCertConfig(r.serviceName))
+}
+
+// newSelfSignedServingCertificate create the serving certificate signed by the self signed CA, the CA
+// is injected to the webhook CABundle
+func (r *CertificateRotator) newSelfSignedServingCertificate(ctx context.Context) (privateKey []byte, cert []byte, err error) {
+	return utils.CreateSelfSignedTLSCert(ctx, r.restConfig, utils.GetCurrentNameSpace(), servingCertConfig(r.serviceName))
+}
+
+func servingCertConfig(serviceName string) *utils.CertConfig {
+	var currentNamespace = utils.GetCurrentNameSpace()
+	return &utils.CertConfig{
+		CertName:     serviceName,
+		CertType:     utils.ServingCert,
+		CommonName:   fmt.Sprintf("%s.%s.svc", serviceName, currentNamespace),
+		Organization: []string{serviceName},
+		DNSName:      append([]string{"127.0.0.1"}, serviceDNSNames(serviceName)...),
+	}
+}
@@ -1,34 +1,41 @@
 package webhook
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gomodules.xyz/jsonpatch/v2"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/golang/glog"
 	v1 "k8s.io/api/admission/v1"
-	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 
 	"github.com/shijunLee/docker-secret-tools/pkg/config"
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
 	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 )
 
@@ -45,14 +52,10 @@ const (
 	mutatingWebhookConfigurationName = "docker-secret-tools-mutating-webhook"
 	mutatingWebhookName              = "docker-secret-tools"
 	configName                       = "docker-secret-tools.shijunlee.net"
+	// readinessEndpoint the readiness probe path served on the webhook listener
+	readinessEndpoint = "/readyz"
 )
 
-type JSONPath struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value"`
-}
-
 //Server kubernetes Webhook server
 type Server struct {
 	server            *http.Server
@@ -61,42 +64,60 @@ type Server struct {
 	dockerSecretNames []string
 	serviceName       string
 	port              int
-	restConfig        *rest.Config
-	TLSPrivateKey     []byte
-	TLSCert           []byte
 	autoTLS           bool
 	rootCA            string
 	privateKeyFile    string
 	certFile          string
+	// secretOrder the order of the injected secrets, the patches are the same for the same object
+	secretOrder []string
+	// dryRun only report the changes with reporter and return warnings without patch
+	dryRun   bool
+	reporter *report.Reporter
+	// recorder record the events of the honored workload annotations
+	recorder record.EventRecorder
+	// secretRequests send the namespaces which miss the image secrets to the namespace controller
+	secretRequests chan<- event.GenericEvent
+	// registryIndex the docker secrets group by registry, kept up to date from the secret informer
+	registryIndex *utils.RegistryIndex
+	certificates  *certificateStore
+	// certManager the serving certificate is issued by cert-manager with the certificateName Certificate
+	certManager     bool
+	certificateName string
+	// shuttingDown set to 1 when the server start shutdown, the readiness fails then
+	shuttingDown        int32
+	shutdownDelay       time.Duration
+	shutdownGracePeriod time.Duration
+	// readyChecks the readiness checks served on the webhook listener with the certificate check. The manager
+	// close the health probe listener when it stop the runnables, so the failed readiness in the shutdown
+	// delay is only served by the webhook listener
+	readyChecks map[string]healthz.Checker
 }
 
 //NewServer create a new webhook http server
-func NewServer(mgr ctrl.Manager, serverConfig *config.Config) *Server {
+func NewServer(mgr ctrl.Manager, serverConfig *config.Config, reporter *report.Reporter,
+	secretRequests chan<- event.GenericEvent, registryIndex *utils.RegistryIndex) *Server {
 	fmt.Println("create new server")
 	serverInstance := &Server{
-		client:            mgr.GetClient(),
-		log:               mgr.GetLogger(),
-		dockerSecretNames: serverConfig.DockerSecretNames,
-		port:              serverConfig.ServerPort,
-		serviceName:       serverConfig.ServiceName,
-		restConfig:        mgr.GetConfig(),
-		autoTLS:           serverConfig.AutoTLS,
-		rootCA:            serverConfig.RootCA,
-		privateKeyFile:    serverConfig.PrivateKeyFile,
-		certFile:          serverConfig.CertFile,
-	}
-	fmt.Println("auto tls", serverConfig.AutoTLS)
-	if serverConfig.AutoTLS {
-		//get tls fail app can not start
-		fmt.Println("start auto tls")
-		privateKey, cert, err := serverInstance.createTLSConfig(context.TODO())
-		if err != nil {
-			serverInstance.log.Error(err, "get server instance cert error")
-			panic(err)
-		}
-		fmt.Println(string(cert))
-		serverInstance.TLSCert = cert
-		serverInstance.TLSPrivateKey = privateKey
+		client:              mgr.GetClient(),
+		log:                 mgr.GetLogger(),
+		dockerSecretNames:   serverConfig.DockerSecretNames,
+		secretOrder:         utils.SecretOrder(serverConfig.SecretPriority, serverConfig.DockerSecretNames),
+		port:                serverConfig.ServerPort,
+		serviceName:         serverConfig.ServiceName,
+		autoTLS:             serverConfig.AutoTLS,
+		rootCA:              serverConfig.RootCA,
+		privateKeyFile:      serverConfig.PrivateKeyFile,
+		certFile:            serverConfig.CertFile,
+		dryRun:              serverConfig.DryRun,
+		reporter:            reporter,
+		recorder:            mgr.GetEventRecorderFor("docker-secret-tools"),
+		secretRequests:      secretRequests,
+		registryIndex:       registryIndex,
+		certificates:        &certificateStore{},
+		certManager:         CertManagerEnabled(serverConfig),
+		certificateName:     CertManagerCertificateName(serverConfig),
+		shutdownDelay:       serverConfig.ShutdownDelay,
+		shutdownGracePeriod: serverConfig.ShutdownGracePeriod,
 	}
 
 	var httpServer = &http.Server{
@@ -107,191 +128,109 @@ func NewServer(mgr ctrl.Manager, serverConfig *config.Config) *Server {
 	return serverInstance
 }
 
-//Start start the webhook server
-func (s *Server) Start(ctx context.Context) {
-
-	// webhook 创建失败，应用立即失败，否则无法使用
-	err := s.createAdmissionWebhook(ctx)
-	if err != nil {
-		s.log.Error(err, "create admission webhook error")
-		panic(err)
-	}
-	defer func() {
-		// 发生宕机时，获取panic传递的上下文并打印
-		err := recover()
-		errInfo, ok := err.(error)
-		if ok {
-			s.log.Error(errInfo, "webhook recover from panic error")
-		} else {
-			fmt.Println("error:", err)
-		}
-	}()
-
-	var ln net.Listener
-	var cert tls.Certificate
+//Start start the webhook server, the server runs on all replicas. The serving certificate is loaded from
+// the secret issued by the leader elected CertificateRotator or cert-manager, or from the mounted files
+func (s *Server) Start(ctx context.Context) error {
 	if s.autoTLS {
-		cert, err = tls.X509KeyPair(s.TLSCert, s.TLSPrivateKey)
-		if err != nil {
-			panic(err)
-		}
-
+		go s.loadCertificate(ctx)
 	} else {
-		cert, err = tls.LoadX509KeyPair(s.certFile, s.privateKeyFile)
-		if err != nil {
-			panic(err)
+		if err := s.loadCertificateFiles(); err != nil {
+			return err
 		}
+		// the mounted certificate files are rotated by others
+		go s.watchCertificateFiles(ctx)
 	}
 	var tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		GetCertificate: s.certificates.GetCertificate,
 	}
-	ln, err = tls.Listen("tcp", s.server.Addr, tlsConfig)
+	ln, err := tls.Listen("tcp", s.server.Addr, tlsConfig)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	s.log.Error(s.server.Serve(ln), "web hook server error")
+	s.server.Handler = s.handler()
+	return s.serve(ctx, ln)
 }
 
-func (s *Server) createTLSConfig(ctx context.Context) (privateKey []byte, cert []byte, err error) {
-	fmt.Println("start createTLSConfig")
-	var secretNotFound = false
-	var secret = &corev1.Secret{}
-	var currentNamespace = utils.GetCurrentNameSpace()
-	err = s.client.Get(ctx, types.NamespacedName{Namespace: currentNamespace, Name: mutatingWebhookConfigurationName}, secret)
-	if err != nil && !k8serrors.IsNotFound(err) {
-		s.log.Error(err, "get tls secret error")
-		return nil, nil, err
-	} else if k8serrors.IsNotFound(err) {
-		secretNotFound = true
-	}
-
-	if !secretNotFound {
-		privateKey = secret.Data["tls.key"]
-		cert = secret.Data["tls.crt"]
-		return
+// AddReadyzCheck add a readiness check served on the webhook listener, it must be called before the server start
+func (s *Server) AddReadyzCheck(name string, check healthz.Checker) {
+	if s.readyChecks == nil {
+		s.readyChecks = map[string]healthz.Checker{}
 	}
+	s.readyChecks[name] = check
+}
 
-	privateKey, cert, err = utils.CreateApproveTLSCert(ctx, s.restConfig, &utils.CertConfig{
-		CertName:     s.serviceName,
-		CertType:     utils.ServingCert,
-		CommonName:   fmt.Sprintf("%s.%s.svc", s.serviceName, currentNamespace),
-		Organization: []string{s.serviceName},
-		DNSName: []string{
-			"127.0.0.1",
-			s.serviceName,
-			fmt.Sprintf("%s.%s", s.serviceName, currentNamespace),
-			fmt.Sprintf("%s.%s.svc", s.serviceName, currentNamespace),
-			fmt.Sprintf("%s.%s.svc.cluster", s.serviceName, currentNamespace),
-			fmt.Sprintf("%s.%s.svc.cluster.local", s.serviceName, currentNamespace),
-		},
-	})
-	if err != nil {
-		s.log.Error(err, "get private key and  cert error")
-		return nil, nil, err
-	}
-	secret = &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      mutatingWebhookConfigurationName,
-			Namespace: currentNamespace,
-		},
-		Type: corev1.SecretTypeTLS,
-		Data: map[string][]byte{
-			"tls.key": privateKey,
-			"tls.crt": cert,
-		},
-	}
-	err = s.client.Create(ctx, secret)
-	if err != nil {
-		s.log.Error(err, "create tls secret error")
-		return nil, nil, err
+// handler route the readiness probe to the readiness checks and the other requests to the admission review
+func (s *Server) handler() http.Handler {
+	var readyz = &healthz.Handler{Checks: map[string]healthz.Checker{"certificate": s.CertificateChecker}}
+	for name, check := range s.readyChecks {
+		readyz.Checks[name] = check
+	}
+	var mux = http.NewServeMux()
+	mux.Handle(readinessEndpoint, http.StripPrefix(readinessEndpoint, readyz))
+	mux.Handle(readinessEndpoint+"/", http.StripPrefix(readinessEndpoint, readyz))
+	mux.Handle("/", s)
+	return mux
+}
+
+// serve serve the listener until the context is done, then shutdown the server gracefully
+func (s *Server) serve(ctx context.Context, ln net.Listener) error {
+	var serveErr = make(chan error, 1)
+	go func() {
+		serveErr <- s.server.Serve(ln)
+	}()
+	select {
+	case err := <-serveErr:
+		s.log.Error(err, "web hook server error")
+		return err
+	case <-ctx.Done():
 	}
-	return
+	return s.shutdown()
 }
 
-func (s *Server) createAdmissionWebhook(ctx context.Context) error {
-	var scope = admissionregistrationv1.AllScopes
-	var mutatingPath = "/mutate"
-	var caBundle []byte
-	var err error
-	if s.autoTLS {
-		caBundle, err = utils.GetKubernetesCA(ctx, s.client)
-		if err != nil {
-			s.log.Error(err, "get kubernetesCA error")
-			return err
-		}
+// shutdown fail the readiness first and keep serving the delay, so no new request is routed to the
+// replica, then drain the in-flight requests within the grace period
+func (s *Server) shutdown() error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.log.Info("web hook server shutting down", "Delay", s.shutdownDelay, "GracePeriod", s.shutdownGracePeriod)
+	time.Sleep(s.shutdownDelay)
+	var ctx = context.Background()
+	if s.shutdownGracePeriod > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.shutdownGracePeriod)
+		defer cancel()
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.log.Error(err, "web hook server shutdown error, close the remaining connections")
+		return s.server.Close()
 	}
+	return nil
+}
 
-	mutatingWebhookConfiguration := &admissionregistrationv1.MutatingWebhookConfiguration{}
-	err = s.client.Get(ctx, types.NamespacedName{Namespace: utils.GetCurrentNameSpace(), Name: mutatingWebhookName}, mutatingWebhookConfiguration)
-	if err != nil && !k8serrors.IsNotFound(err) {
-		s.log.Error(err, "get mutatingWebhook error")
-		return err
-	} else if k8serrors.IsNotFound(err) {
-		mutatingWebhookConfiguration.ObjectMeta = metav1.ObjectMeta{
-			Name:      mutatingWebhookName,
-			Namespace: utils.GetCurrentNameSpace(),
-		}
-		var failurePolicy = admissionregistrationv1.Ignore
-		var sideEffectsConfig = admissionregistrationv1.SideEffectClassNone
-		mutatingWebhookConfiguration.Webhooks = []admissionregistrationv1.MutatingWebhook{
-			{
-				Name:                    configName,
-				SideEffects:             &sideEffectsConfig,
-				AdmissionReviewVersions: []string{"v1", "v1beta1"},
-				FailurePolicy:           &failurePolicy,
-				Rules: []admissionregistrationv1.RuleWithOperations{
-					{
-						Operations: []admissionregistrationv1.OperationType{
-							admissionregistrationv1.Create,
-						},
-						Rule: admissionregistrationv1.Rule{
-							APIGroups:   []string{"", "apps"},
-							APIVersions: []string{"*"},
-							Resources: []string{
-								"deployments",
-								"daemonsets",
-								"replicasets",
-								"pods",
-							},
-							Scope: &scope,
-						},
-					},
-				},
-				ClientConfig: admissionregistrationv1.WebhookClientConfig{
-					Service: &admissionregistrationv1.ServiceReference{
-						Namespace: utils.GetCurrentNameSpace(),
-						Name:      s.serviceName,
-						Path:      &mutatingPath,
-					},
-				},
-			},
-		}
-		if len(caBundle) > 0 {
-			mutatingWebhookConfiguration.Webhooks[0].ClientConfig.CABundle = caBundle
-		}
-		err = s.client.Create(ctx, mutatingWebhookConfiguration)
-		if err != nil {
-			s.log.Error(err, "create mutatingWebhook error")
-			return err
-		}
+//CertificateChecker the readiness check pass when a valid serving certificate is loaded, it fails once
+// the shutdown starts
+func (s *Server) CertificateChecker(_ *http.Request) error {
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		return errors.New("web hook server shutting down")
 	}
-	oldCaBundle := mutatingWebhookConfiguration.Webhooks[0].ClientConfig.CABundle
-	if !bytes.Equal(oldCaBundle, caBundle) {
-		mutatingWebhookConfiguration.Webhooks[0].ClientConfig.CABundle = caBundle
-		err = s.client.Update(ctx, mutatingWebhookConfiguration)
-		if err != nil {
-			s.log.Error(err, "update mutatingWebhook error")
-			return err
-		}
+	var notAfter = s.certificates.NotAfter()
+	if notAfter.IsZero() {
+		return errors.New("serving certificate not loaded")
+	}
+	if time.Now().After(notAfter) {
+		return fmt.Errorf("serving certificate expired at %s", notAfter)
 	}
 	return nil
 }
 
+//NeedLeaderElection the webhook server runs on all replicas
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
 //ServeHTTP the http serve process
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/live" {
-		w.WriteHeader(200)
-		return
-	}
+	var start = time.Now()
+	var kind = "unknown"
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -301,6 +240,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(body) == 0 {
 		s.log.Info("empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
+		metrics.ObserveAdmission(kind, metrics.OutcomeError, start)
 		return
 	}
 
@@ -309,38 +249,37 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if contentType != "application/json" {
 		glog.Errorf("Content-Type=%s, expect application/json", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+		metrics.ObserveAdmission(kind, metrics.OutcomeError, start)
 		return
 	}
 
 	var admissionResponse *v1.AdmissionResponse
-	ar := v1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	// the response must be the same version as the request, the v1 is used when the request can not be decoded
+	var reviewGVK = defaultAdmissionReviewGVK
+	ar, gvk, err := decodeAdmissionReview(body)
+	if err != nil {
 		admissionResponse = &v1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	} else {
-		fmt.Println(r.URL.Path)
+		reviewGVK = *gvk
+		if ar.Request != nil {
+			kind = ar.Request.Kind.Kind
+		}
 		if r.URL.Path == "/mutate" {
-			admissionResponse = s.mutate(r.Context(), &ar)
+			admissionResponse = s.mutate(r.Context(), ar)
 		} else if r.URL.Path == "/validate" {
-			admissionResponse = s.validate(&ar)
+			admissionResponse = s.validate(ar)
 		}
-	}
-
-	admissionReview := v1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "AdmissionReview",
-			APIVersion: "admission.k8s.io/v1",
-		},
-	}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+		if admissionResponse != nil && ar.Request != nil {
+			admissionResponse.UID = ar.Request.UID
 		}
 	}
+
+	metrics.ObserveAdmission(kind, admissionOutcome(admissionResponse), start)
+	admissionReview := encodeAdmissionReview(reviewGVK, admissionResponse)
 	resp, err := json.Marshal(admissionReview)
 	s.log.Info("resp info", "Resp", string(resp))
 	if err != nil {
@@ -366,61 +305,123 @@ func (s *Server) mutate(ctx context.Context, ar *v1.AdmissionReview) *v1.Admissi
 	req := ar.Request
 	s.log.Info("get mutate event", req.Kind.Kind, req.Kind.Group, req.Name, req.Namespace)
 	var patchBytes []byte
-	if req.Operation == v1.Connect || req.Operation == v1.Delete {
+	var warnings []string
+	// the namespace selector not exclude the webhook namespace on the clusters before kubernetes 1.21
+	if req.Operation == v1.Connect || req.Operation == v1.Delete || req.Namespace == utils.GetCurrentNameSpace() {
 		return &v1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 	switch req.Kind.Kind {
 	case "Deployment", "DaemonSet", "ReplicaSet", "Pod":
-		jsonOrYamlData := req.Object.Raw
-		jsonString := ""
-		var rawString = string(jsonOrYamlData)
-		s.log.Info("json data info", "JSON data", rawString)
-		if strings.HasPrefix(strings.TrimLeft(rawString, " "), "{") {
-			jsonString = rawString
-		} else {
-
-			jsonData, err := yaml.YAMLToJSON(jsonOrYamlData)
-			if err != nil {
-				s.log.Error(err, "get raw data from not json error", "RawData", rawString)
-				break
+		object, err := decodeObject(req.Object.Raw)
+		if err != nil {
+			s.log.Error(err, "decode admission object error")
+			break
+		}
+		// the object of create request not exist yet, the events are recorded with the generate name
+		if object.GetName() == "" {
+			object.SetName(object.GetGenerateName())
+		}
+		if object.GetNamespace() == "" {
+			object.SetNamespace(req.Namespace)
+		}
+		var recordEvents = req.DryRun == nil || !*req.DryRun
+		var recordInjection = recordEvents && injectionEventsNeeded(req, object)
+		var injection = utils.ParseWorkloadInjection(object)
+		if injection.Skip {
+			if recordInjection {
+				injection.Record(s.recorder, object, nil)
 			}
-			jsonString = string(jsonData)
+			break
 		}
-		s.log.Info("json String", "JSON  String", jsonString)
-		imageList, err := utils.GetImageFromJSON(ctx, jsonString)
+		images, err := utils.ObjectImages(object)
 		if err != nil {
 			s.log.Error(err, "get image from data error")
 			break
 		}
+		imageList := utils.ImageNames(images)
 		s.log.Info("imageList", "imageList", imageList)
 		if len(imageList) == 0 {
 			s.log.Info("imageList not found")
 			break
 		}
-		imageSecrets := s.getImagesSecrets(ctx, imageList)
+		var registrySecrets = s.registryIndex.RegistrySecrets()
+		// all secrets the current images need, the secrets added by the tool before
+		// and not in it will be removed from the object
+		var requiredSecrets []string
+		allSecrets, missing := injection.Select(registrySecrets, imageList)
+		for _, item := range allSecrets {
+			requiredSecrets = append(requiredSecrets, item.Name)
+		}
+		if recordInjection {
+			injection.Record(s.recorder, object, missing)
+		}
+		if req.Operation == v1.Update {
+			// only the images added by this update need new secrets, secrets
+			// the user set on the object are never removed
+			oldObject, err := decodeObject(req.OldObject.Raw)
+			if err != nil {
+				s.log.Error(err, "decode admission old object error")
+				break
+			}
+			oldImages, err := utils.ObjectImages(oldObject)
+			if err != nil {
+				s.log.Error(err, "get image from old data error")
+				break
+			}
+			imageList = newImages(utils.ImageNames(oldImages), imageList)
+			s.log.Info("update new imageList", "imageList", imageList)
+		}
+		// the user see the images can not be pulled with the tool credentials on kubectl apply
+		warnings = append(warnings, missingCredentialWarnings(registrySecrets, imageList)...)
+		imageSecrets, _ := injection.Select(registrySecrets, imageList)
+		imageSecrets = utils.OrderSecrets(imageSecrets, s.secretOrder)
+		// the imagePullSecrets of an existing pod can not be changed, the patch would reject the update
+		if req.Kind.Kind == "Pod" && req.Operation == v1.Update {
+			warnings = append(warnings, podUpdateWarnings(object, imageSecrets)...)
+			break
+		}
 		s.log.Info("get image secrets", "imageSecrets", imageSecrets)
 		var replaceImageSecrets []string
+		var missingSecret = false
 		for _, item := range imageSecrets {
+			replaceImageSecrets = append(replaceImageSecrets, item.Name)
 			var secret = &corev1.Secret{}
 			err = s.client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: item.Name}, secret)
 			if err != nil && k8serrors.IsNotFound(err) {
-				item.Namespace = req.Namespace
-				err = s.client.Create(ctx, &item)
-				if err != nil {
-					s.log.Error(err, "create secret error", "SecretName", item.Name)
-				} else {
-					replaceImageSecrets = append(replaceImageSecrets, item.Name)
+				missingSecret = true
+				if s.dryRun {
+					var action = report.Action{Source: "Webhook", Action: report.ActionCreateSecret, Kind: "Secret",
+						Namespace: req.Namespace, Name: item.Name}
+					s.reporter.Record(nil, action)
+					warnings = append(warnings, action.Message())
 				}
-			} else {
-				replaceImageSecrets = append(replaceImageSecrets, item.Name)
 			}
 		}
+		// the secrets are created by the namespace controller, the kubelet retry pulling the
+		// images until the secrets exist. Nothing is requested for the dry run admission request
+		if missingSecret && !s.dryRun && recordEvents {
+			s.requestSecrets(req.Namespace)
+		}
 		s.log.Info("get replace Image Secrets", "replaceImageSecrets", replaceImageSecrets)
-		if len(replaceImageSecrets) > 0 {
-			patchBytes = applySecret([]byte(jsonString), req.Kind.Kind, replaceImageSecrets)
-			s.log.Info("patch data", "patch", string(patchBytes))
+		patchBytes = applySecret(req.Object.Raw, req.Kind.Kind, replaceImageSecrets, requiredSecrets)
+		s.log.Info("patch data", "patch", string(patchBytes))
+		// the dry run admission request is not persisted, nothing is injected
+		if !s.dryRun && recordEvents && len(patchBytes) > 0 {
+			utils.RecordInjectedSecrets(registrySecrets, imageSecrets)
+		}
+		if s.dryRun && len(patchBytes) > 0 {
+			var action = report.Action{Source: "Webhook", Action: report.ActionPatchImagePullSecrets, Kind: req.Kind.Kind,
+				Namespace: req.Namespace, Name: object.GetName(), Detail: fmt.Sprintf("patch %s", string(patchBytes))}
+			// the webhook has no side effects on the dry run admission requests, no event is created
+			var eventObject runtime.Object
+			if recordEvents {
+				eventObject = object
+			}
+			s.reporter.Record(eventObject, action)
+			warnings = append(warnings, action.Message())
+			patchBytes = nil
 		}
 	default:
 		s.log.Info("return admission for kind not support")
@@ -433,9 +434,10 @@ func (s *Server) mutate(ctx context.Context, ar *v1.AdmissionReview) *v1.Admissi
 	if len(patchBytes) > 0 {
 		s.log.Info("return admission patch data", "patch", string(patchBytes))
 		return &v1.AdmissionResponse{
-			UID:     req.UID,
-			Allowed: true,
-			Patch:   patchBytes,
+			UID:      req.UID,
+			Allowed:  true,
+			Patch:    patchBytes,
+			Warnings: warnings,
 			PatchType: func() *v1.PatchType {
 				pt := v1.PatchTypeJSONPatch
 				return &pt
@@ -444,256 +446,194 @@ func (s *Server) mutate(ctx context.Context, ar *v1.AdmissionReview) *v1.Admissi
 	} else {
 		s.log.Info("return no patch for support")
 		return &v1.AdmissionResponse{
-			Allowed: true,
-			UID:     req.UID,
+			Allowed:  true,
+			UID:      req.UID,
+			Warnings: warnings,
 		}
 	}
 }
 
-func getImages(data []byte, kind string) []string {
-	var result []string
-	var podInfo = getPodTemplate(data, kind)
-	if podInfo == nil {
-		return nil
-	}
-	for _, c := range podInfo.Containers {
-		result = append(result, c.Image)
+// missingCredentialWarnings the admission warnings of the images which registry has no docker secret
+func missingCredentialWarnings(registrySecrets map[string][]corev1.Secret, images []string) []string {
+	var warnings []string
+	var warned = map[string]bool{}
+	for _, image := range images {
+		var registry = utils.ImageRegistry(image)
+		if len(registrySecrets[registry]) > 0 || warned[image] {
+			continue
+		}
+		warned[image] = true
+		warnings = append(warnings, fmt.Sprintf("image %s from registry %s has no configured pull credential", image, registry))
 	}
-	return result
+	return warnings
 }
 
-func localObjectReferenceContain(localObjectReference corev1.LocalObjectReference, array []corev1.LocalObjectReference) bool {
-	if len(array) == 0 {
-		return false
+// podUpdateWarnings the admission warnings of the secrets the new images of the pod need but not on the pod
+func podUpdateWarnings(pod *unstructured.Unstructured, imageSecrets []corev1.Secret) []string {
+	var current = map[string]bool{}
+	spec, err := utils.ObjectPodSpec(pod)
+	if err == nil && spec != nil {
+		for _, item := range spec.ImagePullSecrets {
+			current[item.Name] = true
+		}
 	}
-	for _, item := range array {
-		if localObjectReference.Name == item.Name {
-			return true
+	var warnings []string
+	for _, item := range imageSecrets {
+		if !current[item.Name] {
+			warnings = append(warnings, fmt.Sprintf("imagePullSecrets of pod %s can not be changed, secret %s is not added for the new images",
+				pod.GetName(), item.Name))
 		}
 	}
-	return false
+	return warnings
 }
 
-func applySecret(data []byte, kind string, secrets []string) []byte {
-	var operations []jsonpatch.Operation
-	switch kind {
-	case "Deployment":
-		var deployment = &appsv1.Deployment{}
-		err := json.Unmarshal(data, deployment)
-		if err != nil {
-			return nil
-		}
-		newDeployment := deployment.DeepCopy()
-		for _, item := range secrets {
-			var secretItem = corev1.LocalObjectReference{Name: item}
-			if !localObjectReferenceContain(secretItem, deployment.Spec.Template.Spec.ImagePullSecrets) {
-				deployment.Spec.Template.Spec.ImagePullSecrets = append(deployment.Spec.Template.Spec.ImagePullSecrets)
+// sortOperations sort the patch operations by the path before the first array index, the operations are
+// created in the random map order. The operations of the same array keep their order
+func sortOperations(operations []jsonpatch.Operation) {
+	var key = func(path string) string {
+		var segments = strings.Split(path, "/")
+		for index, item := range segments {
+			if _, err := strconv.Atoi(item); err == nil && item != "" {
+				return strings.Join(segments[:index], "/")
 			}
 		}
-		newDeploymentData, err := json.Marshal(newDeployment)
-		if err != nil {
-			return nil
-		}
-		//resultData, err := strategicpatch.CreateTwoWayMergePatch(data, newDeploymentData, appsv1.Deployment{})
-		resultData, err := jsonpatch.CreatePatch(data, newDeploymentData)
-		if err != nil {
-			return nil
-		}
-		operations = resultData
-	case "DaemonSet":
-		var ds = &appsv1.DaemonSet{}
-		err := json.Unmarshal(data, ds)
-		if err != nil {
-			return nil
-		}
-		newDS := ds.DeepCopy()
-		for _, item := range secrets {
-			var secretItem = corev1.LocalObjectReference{Name: item}
-			if !localObjectReferenceContain(secretItem, newDS.Spec.Template.Spec.ImagePullSecrets) {
-				newDS.Spec.Template.Spec.ImagePullSecrets = append(newDS.Spec.Template.Spec.ImagePullSecrets)
-			}
-		}
-		newDSData, err := json.Marshal(newDS)
-		if err != nil {
-			return nil
-		}
+		return path
+	}
+	sort.SliceStable(operations, func(i, j int) bool {
+		return key(operations[i].Path) < key(operations[j].Path)
+	})
+}
 
-		//resultData, err := strategicpatch.CreateTwoWayMergePatch(data, newDSData, appsv1.DaemonSet{})
-		resultData, err := jsonpatch.CreatePatch(data, newDSData)
-		if err != nil {
-			return nil
-		}
-		operations = resultData
-	case "StatefulSet":
-		var sts = &appsv1.StatefulSet{}
-		err := json.Unmarshal(data, sts)
-		if err != nil {
-			return nil
-		}
-		newSTS := sts.DeepCopy()
-		for _, item := range secrets {
-			var secretItem = corev1.LocalObjectReference{Name: item}
-			if !localObjectReferenceContain(secretItem, newSTS.Spec.Template.Spec.ImagePullSecrets) {
-				newSTS.Spec.Template.Spec.ImagePullSecrets = append(newSTS.Spec.Template.Spec.ImagePullSecrets)
-			}
-		}
-		newSTSData, err := json.Marshal(newSTS)
-		if err != nil {
-			return nil
-		}
-		//resultData, err := strategicpatch.CreateTwoWayMergePatch(data, newSTSData, appsv1.StatefulSet{})
-		resultData, err := jsonpatch.CreatePatch(data, newSTSData)
-		if err != nil {
-			return nil
-		}
-		operations = resultData
-	case "ReplicaSet":
-		var rs = &appsv1.ReplicaSet{}
-		err := json.Unmarshal(data, rs)
-		if err != nil {
-			return nil
-		}
-		newRS := rs.DeepCopy()
-		for _, item := range secrets {
-			var secretItem = corev1.LocalObjectReference{Name: item}
-			if !localObjectReferenceContain(secretItem, newRS.Spec.Template.Spec.ImagePullSecrets) {
-				newRS.Spec.Template.Spec.ImagePullSecrets = append(newRS.Spec.Template.Spec.ImagePullSecrets)
-			}
-		}
-		newRSData, err := json.Marshal(newRS)
-		if err != nil {
-			return nil
-		}
-		//resultData, err := strategicpatch.CreateTwoWayMergePatch(data, newRSData, appsv1.ReplicaSet{})
-		resultData, err := jsonpatch.CreatePatch(data, newRSData)
-		if err != nil {
-			return nil
-		}
-		operations = resultData
-	case "Pod":
-		var pod = &corev1.Pod{}
-		err := json.Unmarshal(data, pod)
+// admissionOutcome the outcome of the admission response for the metrics
+func admissionOutcome(response *v1.AdmissionResponse) string {
+	if response == nil || !response.Allowed {
+		return metrics.OutcomeError
+	}
+	if len(response.Patch) > 0 {
+		return metrics.OutcomePatched
+	}
+	return metrics.OutcomeAllowed
+}
+
+// requestSecrets ask the namespace controller to create the image secrets in the namespace. The request
+// is dropped when the controller is busy or not running on this replica, the next admission request
+// in the namespace will request the secrets again
+func (s *Server) requestSecrets(namespace string) {
+	if s.secretRequests == nil {
+		return
+	}
+	select {
+	case s.secretRequests <- event.GenericEvent{Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}}:
+	default:
+		s.log.Info("secret request dropped", "Namespace", namespace)
+	}
+}
+
+// decodeObject decode the admission object, the raw object of the admission request is always json
+func decodeObject(raw []byte) (*unstructured.Unstructured, error) {
+	var object = &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// injectionEventsNeeded check the injection annotation events are recorded for the request. The events are
+// recorded on the created object which is not created by a controller, the objects created by the controller
+// inherit the annotations of the owner, and on the updated object which annotations or pod template changed
+func injectionEventsNeeded(req *v1.AdmissionRequest, object *unstructured.Unstructured) bool {
+	switch req.Operation {
+	case v1.Create:
+		return metav1.GetControllerOf(object) == nil
+	case v1.Update:
+		oldObject, err := decodeObject(req.OldObject.Raw)
 		if err != nil {
-			return data
+			return false
 		}
-		newPod := pod.DeepCopy()
-		for _, item := range secrets {
-			var secretItem = corev1.LocalObjectReference{Name: item}
-			if !localObjectReferenceContain(secretItem, newPod.Spec.ImagePullSecrets) {
-				newPod.Spec.ImagePullSecrets = append(newPod.Spec.ImagePullSecrets)
+		return utils.InjectionState(oldObject) != utils.InjectionState(object)
+	}
+	return false
+}
+
+// newImages get the images in newImageList which not in oldImageList
+func newImages(oldImageList, newImageList []string) []string {
+	var result []string
+	for _, image := range newImageList {
+		var found = false
+		for _, oldImage := range oldImageList {
+			if image == oldImage {
+				found = true
+				break
 			}
 		}
-		newPodData, err := json.Marshal(newPod)
-		if err != nil {
-			return nil
-		}
-		//resultData, err := strategicpatch.CreateTwoWayMergePatch(data, newPodData, corev1.Pod{})
-		resultData, err := jsonpatch.CreatePatch(data, newPodData)
-		if err != nil {
-			return nil
+		if !found {
+			result = append(result, image)
 		}
-		operations = resultData
 	}
-	if len(operations) > 0 {
-		operationData, err := json.Marshal(operations)
-		if err != nil {
-			return nil
-		}
-		return operationData
-	}
-	return nil
+	return result
 }
 
-func getPodTemplate(data []byte, kind string) *corev1.PodSpec {
+// applySecret create the json patch which add secrets to the object pod template imagePullSecrets
+// and remove the secrets added by the tool before which not in required,
+// the patch is computed from the typed object so fields unknown to the type are never touched
+func applySecret(data []byte, kind string, secrets []string, required []string) []byte {
+	var object interface{}
+	var podMeta *metav1.ObjectMeta
+	var podSpec *corev1.PodSpec
 	switch kind {
 	case "Deployment":
 		var deployment = &appsv1.Deployment{}
-		err := json.Unmarshal(data, deployment)
-		if err != nil {
-			return nil
-		}
-		return &(deployment.Spec.Template.Spec)
+		object, podMeta, podSpec = deployment, &deployment.Spec.Template.ObjectMeta, &deployment.Spec.Template.Spec
 	case "DaemonSet":
 		var ds = &appsv1.DaemonSet{}
-		err := json.Unmarshal(data, ds)
-		if err != nil {
-			return nil
-		}
-		return &(ds.Spec.Template.Spec)
+		object, podMeta, podSpec = ds, &ds.Spec.Template.ObjectMeta, &ds.Spec.Template.Spec
 	case "StatefulSet":
 		var sts = &appsv1.StatefulSet{}
-		err := json.Unmarshal(data, sts)
-		if err != nil {
-			return nil
-		}
-		return &(sts.Spec.Template.Spec)
+		object, podMeta, podSpec = sts, &sts.Spec.Template.ObjectMeta, &sts.Spec.Template.Spec
 	case "ReplicaSet":
 		var rs = &appsv1.ReplicaSet{}
-		err := json.Unmarshal(data, rs)
-		if err != nil {
-			return nil
-		}
-		return &(rs.Spec.Template.Spec)
+		object, podMeta, podSpec = rs, &rs.Spec.Template.ObjectMeta, &rs.Spec.Template.Spec
 	case "Pod":
 		var pod = &corev1.Pod{}
-		err := json.Unmarshal(data, pod)
+		object, podMeta, podSpec = pod, &pod.ObjectMeta, &pod.Spec
+	default:
+		return nil
+	}
+	err := json.Unmarshal(data, object)
+	if err != nil {
+		return nil
+	}
+	originalData, err := json.Marshal(object)
+	if err != nil {
+		return nil
+	}
+	var current []string
+	for _, item := range podSpec.ImagePullSecrets {
+		current = append(current, item.Name)
+	}
+	managed := utils.ParseManagedPullSecrets(podMeta.Annotations)
+	result, resultManaged := utils.MergeImagePullSecrets(current, managed, secrets, required)
+	var imagePullSecrets []corev1.LocalObjectReference
+	for _, item := range result {
+		imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{Name: item})
+	}
+	podSpec.ImagePullSecrets = imagePullSecrets
+	podMeta.Annotations = utils.SetManagedPullSecrets(podMeta.Annotations, resultManaged)
+	newData, err := json.Marshal(object)
+	if err != nil {
+		return nil
+	}
+	operations, err := jsonpatch.CreatePatch(originalData, newData)
+	if err != nil {
+		return nil
+	}
+	sortOperations(operations)
+	if len(operations) > 0 {
+		operationData, err := json.Marshal(operations)
 		if err != nil {
 			return nil
 		}
-		return &(pod.Spec)
+		return operationData
 	}
-
 	return nil
 }
-
-func (s *Server) getImagesSecrets(ctx context.Context, images []string) []corev1.Secret {
-	var registrySecrets = s.getSecretAuthRegistry(ctx)
-	var result = []corev1.Secret{}
-
-	for k, v := range registrySecrets {
-		for _, image := range images {
-			imagePathURLSplits := strings.Split(image, ":")
-			if len(imagePathURLSplits) == 0 {
-				continue
-			}
-			imagePathSplits := strings.Split(imagePathURLSplits[0], "/")
-			if len(imagePathSplits) == 0 {
-				continue
-			}
-			imageHost := imagePathSplits[0]
-			if imageHost == k {
-				for _, item := range v {
-					result = append(result, item)
-				}
-			}
-		}
-	}
-	return result
-}
-
-func (s *Server) getSecretAuthRegistry(ctx context.Context) map[string][]corev1.Secret {
-	var result = map[string][]corev1.Secret{}
-	var secrets = utils.GetDockerSecrets(ctx, s.client, s.log, s.dockerSecretNames)
-	for _, item := range secrets {
-		configData, ok := item.Data[".dockerconfigjson"]
-		if ok {
-			var dockerSecrets = &utils.DockerSecrets{}
-			err := json.Unmarshal(configData, dockerSecrets)
-			if err == nil {
-				for key, _ := range dockerSecrets.Auths {
-					if values, ok := result[key]; ok {
-						values = append(values, *item)
-						result[key] = values
-					} else {
-						var values []corev1.Secret
-						values = append(values, *item)
-						result[key] = values
-					}
-				}
-			} else {
-				s.log.Error(err, "unmarshal docker secret to docker config error")
-			}
-		}
-	}
-	return result
-}
@@ -1,13 +1,38 @@
 package webhook
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/yaml"
+
+	"github.com/shijunLee/docker-secret-tools/pkg/metrics"
+	"github.com/shijunLee/docker-secret-tools/pkg/report"
+	"github.com/shijunLee/docker-secret-tools/pkg/utils"
 )
 
 var testyaml = `
@@ -75,11 +100,7 @@ func Test_JsonPatch(t *testing.T) {
 	// if err != nil {
 	// 	panic(err)
 	// }
-	var testTemplate = getPodTemplate(original, "Deployment")
-	if testTemplate == nil {
-		t.Fatal()
-		return
-	}
+	var testTemplate = testPodSpec(t, original)
 	var newTemp = *testTemplate
 	newTemp.ImagePullSecrets = append(testTemplate.ImagePullSecrets, corev1.LocalObjectReference{Name: "tpaas-itg"})
 	originalPodData, err := json.Marshal(testTemplate)
@@ -114,3 +135,585 @@ func Test_JsonPatch(t *testing.T) {
 	fmt.Printf("patch document:   %s\n", string(data))
 	fmt.Printf("updated alternative doc: %s\n", modifiedAlternative)
 }
+
+func Test_ApplySecret(t *testing.T) {
+	original, err := yaml.YAMLToJSON([]byte(testyaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchData := applySecret(original, "Deployment", []string{"tpaas-itg"}, []string{"tpaas-itg"})
+	if len(patchData) == 0 {
+		t.Fatal("expect patch data for deployment")
+	}
+	patch, err := jsonpatch.DecodePatch(patchData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := patch.Apply(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var podSpec = testPodSpec(t, data)
+	if len(podSpec.ImagePullSecrets) != 1 || podSpec.ImagePullSecrets[0].Name != "tpaas-itg" {
+		t.Fatalf("unexpected patched object %s", string(data))
+	}
+	// the secret already exists, no patch is needed
+	if patchData = applySecret(data, "Deployment", []string{"tpaas-itg"}, []string{"tpaas-itg"}); len(patchData) > 0 {
+		t.Fatalf("unexpected patch %s", string(patchData))
+	}
+	// the image no longer need the secret, the secret added by the tool is removed
+	patchData = applySecret(data, "Deployment", nil, nil)
+	patch, err = jsonpatch.DecodePatch(patchData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = patch.Apply(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podSpec = testPodSpec(t, data)
+	if len(podSpec.ImagePullSecrets) != 0 {
+		t.Fatalf("unexpected patched object %s", string(data))
+	}
+}
+
+func Test_NewImages(t *testing.T) {
+	var oldImages = []string{"docker.shijunlee.local/library/nginx:latest"}
+	var images = []string{"docker.shijunlee.local/library/nginx:latest", "registry.shijunlee.local/library/busybox:1.32"}
+	result := newImages(oldImages, images)
+	if len(result) != 1 || result[0] != "registry.shijunlee.local/library/busybox:1.32" {
+		t.Fatalf("unexpected new images %v", result)
+	}
+	if result = newImages(images, oldImages); len(result) != 0 {
+		t.Fatalf("unexpected new images %v", result)
+	}
+}
+
+// testPodSpec get the pod template spec of the object json
+func testPodSpec(t *testing.T, data []byte) *corev1.PodSpec {
+	object, err := decodeObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	podSpec, err := utils.ObjectPodSpec(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if podSpec == nil {
+		t.Fatalf("no pod spec in %s", string(data))
+	}
+	return podSpec
+}
+
+// newTestSourceSecret the source docker secret of the docker.shijunlee.local registry in the tool namespace
+func newTestSourceSecret(name string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "tool-test"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"docker.shijunlee.local":{"auth":"dGVzdDp0ZXN0"}}}`),
+		},
+	}
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Setenv("DEBUG_NAMESPACE", "tool-test")
+	var scheme = runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	var sourceSecret = newTestSourceSecret("tpaas-itg")
+	var registryIndex = utils.NewRegistryIndex(zap.New(), []string{"tpaas-itg"})
+	registryIndex.Update(sourceSecret)
+	return &Server{
+		client:            fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceSecret).Build(),
+		log:               zap.New(),
+		dockerSecretNames: []string{"tpaas-itg"},
+		registryIndex:     registryIndex,
+	}
+}
+
+func newTestAdmissionReview(t *testing.T, operation v1.Operation) *v1.AdmissionReview {
+	original, err := yaml.YAMLToJSON([]byte(testyaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Name:      "nginx-test",
+			Namespace: "test1",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: original},
+		},
+	}
+}
+
+func Test_MutateDryRun(t *testing.T) {
+	var server = newTestServer(t)
+	server.dryRun = true
+	server.reporter = report.NewReporter(zap.New(), nil)
+	response := server.mutate(context.TODO(), newTestAdmissionReview(t, v1.Create))
+	if !response.Allowed || len(response.Patch) > 0 {
+		t.Fatalf("unexpected response %v", response)
+	}
+	if len(response.Warnings) != 2 {
+		t.Fatalf("expect the secret create and patch warnings, got %v", response.Warnings)
+	}
+	if err := server.client.Get(context.TODO(), types.NamespacedName{Namespace: "test1", Name: "tpaas-itg"}, &corev1.Secret{}); err == nil {
+		t.Fatal("expect no secret created in dry run")
+	}
+	if summary := server.reporter.Summary(); len(summary.Actions) != 2 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+}
+
+func Test_MutateDryRunRequestNoEvent(t *testing.T) {
+	var server = newTestServer(t)
+	server.dryRun = true
+	var recorder = record.NewFakeRecorder(10)
+	server.reporter = report.NewReporter(zap.New(), recorder)
+	var review = newTestAdmissionReview(t, v1.Create)
+	review.Request.DryRun = pointer.BoolPtr(true)
+	response := server.mutate(context.TODO(), review)
+	if len(response.Patch) > 0 || len(response.Warnings) != 2 {
+		t.Fatalf("unexpected response %v", response)
+	}
+	select {
+	case item := <-recorder.Events:
+		t.Fatalf("expect no event for the dry run admission request, got %s", item)
+	default:
+	}
+}
+
+func Test_MutateSecretRequests(t *testing.T) {
+	var server = newTestServer(t)
+	var secretRequests = make(chan event.GenericEvent, 1)
+	server.secretRequests = secretRequests
+	var review = newTestAdmissionReview(t, v1.Create)
+	var dryRun = true
+	review.Request.DryRun = &dryRun
+	var injected = testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local"))
+	response := server.mutate(context.TODO(), review)
+	if len(response.Patch) == 0 {
+		t.Fatal("expect the dry run request patched")
+	}
+	if value := testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local")); value != injected {
+		t.Fatalf("expect the dry run request not counted, got %v", value)
+	}
+	if len(secretRequests) > 0 {
+		t.Fatal("expect no secret request for dry run request")
+	}
+
+	review.Request.DryRun = nil
+	response = server.mutate(context.TODO(), review)
+	if len(response.Patch) == 0 {
+		t.Fatal("expect the request patched")
+	}
+	if err := server.client.Get(context.TODO(), types.NamespacedName{Namespace: "test1", Name: "tpaas-itg"}, &corev1.Secret{}); err == nil {
+		t.Fatal("expect no secret created in admission request")
+	}
+	select {
+	case request := <-secretRequests:
+		if request.Object.GetName() != "test1" {
+			t.Fatalf("unexpected secret request %v", request.Object.GetName())
+		}
+	default:
+		t.Fatal("expect secret request for namespace test1")
+	}
+}
+
+func Test_ServeGracefulShutdown(t *testing.T) {
+	var server = newTestServer(t)
+	server.shutdownDelay = 200 * time.Millisecond
+	server.shutdownGracePeriod = 5 * time.Second
+	var started = make(chan struct{})
+	server.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var url = "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.TODO())
+	var serveErr = make(chan error, 1)
+	go func() {
+		serveErr <- server.serve(ctx, ln)
+	}()
+	var inflight = make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/mutate")
+		if err != nil {
+			inflight <- 0
+			return
+		}
+		resp.Body.Close()
+		inflight <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	// the readiness fails while the server keep serving in the delay
+	time.Sleep(50 * time.Millisecond)
+	if err := server.CertificateChecker(nil); err == nil {
+		t.Fatal("expect the readiness failed")
+	}
+	if code := <-inflight; code != http.StatusOK {
+		t.Fatalf("expect the in-flight request finished, got %d", code)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ServeReadyzShutdown(t *testing.T) {
+	var server = newTestServer(t)
+	server.shutdownDelay = 500 * time.Millisecond
+	server.certificates = &certificateStore{}
+	privateKey, cert := newTestCertificate(t)
+	if err := server.certificates.Set(cert, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	server.AddReadyzCheck("ping", func(_ *http.Request) error { return nil })
+	server.server = &http.Server{Handler: server.handler()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var url = "http://" + ln.Addr().String() + "/readyz"
+	var probe = func() int {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	var serveErr = make(chan error, 1)
+	go func() {
+		serveErr <- server.serve(ctx, ln)
+	}()
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("expect the readiness passed before shutdown, got %d", code)
+	}
+	cancel()
+
+	// the probe is still served by the webhook listener in the delay and fails
+	time.Sleep(100 * time.Millisecond)
+	if code := probe(); code != http.StatusInternalServerError {
+		t.Fatalf("expect the readiness failed in the shutdown delay, got %d", code)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ServeHTTPMetrics(t *testing.T) {
+	var server = newTestServer(t)
+	var review = newTestAdmissionReview(t, v1.Create)
+	review.TypeMeta = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patched = testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues("Deployment", metrics.OutcomePatched))
+	var injected = testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local"))
+	var request = httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	var recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	if value := testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues("Deployment", metrics.OutcomePatched)); value != patched+1 {
+		t.Fatalf("expect the patched admission counted, got %v", value)
+	}
+	if value := testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local")); value != injected+1 {
+		t.Fatalf("expect the injected secret counted, got %v", value)
+	}
+}
+
+func Test_CertificateChecker(t *testing.T) {
+	var server = newTestServer(t)
+	server.certificates = &certificateStore{}
+	if err := server.CertificateChecker(nil); err == nil {
+		t.Fatal("expect error for no certificate loaded")
+	}
+	privateKey, cert := newTestCertificate(t)
+	if err := server.certificates.Set(cert, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CertificateChecker(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MutateMissingCredentialWarnings(t *testing.T) {
+	var server = newTestServer(t)
+	var review = newTestAdmissionReview(t, v1.Create)
+	var object = &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON(review.Request.Object.Raw); err != nil {
+		t.Fatal(err)
+	}
+	var containers = []interface{}{
+		map[string]interface{}{"name": "nginx", "image": "docker.shijunlee.local/library/nginx:latest"},
+		map[string]interface{}{"name": "sidecar", "image": "quay.io/app/sidecar:v1"},
+		map[string]interface{}{"name": "other", "image": "quay.io/app/sidecar:v1"},
+	}
+	if err := unstructured.SetNestedSlice(object.Object, containers, "spec", "template", "spec", "containers"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := object.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Object.Raw = raw
+	response := server.mutate(context.TODO(), review)
+	if len(response.Patch) == 0 {
+		t.Fatal("expect the secret of the known registry patched")
+	}
+	var expect = []string{"image quay.io/app/sidecar:v1 from registry quay.io has no configured pull credential"}
+	if !reflect.DeepEqual(response.Warnings, expect) {
+		t.Fatalf("unexpected warnings %v", response.Warnings)
+	}
+}
+
+func Test_MutateAnnotations(t *testing.T) {
+	var setAnnotation = func(t *testing.T, review *v1.AdmissionReview, key, value string) {
+		var object = &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(review.Request.Object.Raw); err != nil {
+			t.Fatal(err)
+		}
+		object.SetAnnotations(map[string]string{key: value})
+		raw, err := object.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.Object.Raw = raw
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		var server = newTestServer(t)
+		var recorder = record.NewFakeRecorder(10)
+		server.recorder = recorder
+		var review = newTestAdmissionReview(t, v1.Create)
+		setAnnotation(t, review, utils.SkipAnnotation, "true")
+		if response := server.mutate(context.TODO(), review); len(response.Patch) != 0 {
+			t.Fatalf("expect no patch, got %s", string(response.Patch))
+		}
+		if event := <-recorder.Events; !strings.Contains(event, utils.EventReasonInjectionSkipped) {
+			t.Fatalf("unexpected event %s", event)
+		}
+	})
+
+	t.Run("registries", func(t *testing.T) {
+		var server = newTestServer(t)
+		var recorder = record.NewFakeRecorder(10)
+		server.recorder = recorder
+		var review = newTestAdmissionReview(t, v1.Create)
+		// the images are not pulled from the registry, the secret is injected by the annotation
+		var object = &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(review.Request.Object.Raw); err != nil {
+			t.Fatal(err)
+		}
+		var containers = []interface{}{map[string]interface{}{"name": "nginx", "image": "nginx:latest"}}
+		if err := unstructured.SetNestedSlice(object.Object, containers, "spec", "template", "spec", "containers"); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := object.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.Object.Raw = raw
+		setAnnotation(t, review, utils.RegistriesAnnotation, "docker.shijunlee.local")
+		var injected = testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local"))
+		response := server.mutate(context.TODO(), review)
+		if !strings.Contains(string(response.Patch), "tpaas-itg") {
+			t.Fatalf("expect the requested secret patched, got %s", string(response.Patch))
+		}
+		if value := testutil.ToFloat64(metrics.SecretsInjected.WithLabelValues("docker.shijunlee.local")); value != injected+1 {
+			t.Fatalf("expect the requested secret counted, got %v", value)
+		}
+		if event := <-recorder.Events; !strings.Contains(event, utils.EventReasonRegistriesRequested) {
+			t.Fatalf("unexpected event %s", event)
+		}
+	})
+
+	t.Run("inherited pod create", func(t *testing.T) {
+		var server = newTestServer(t)
+		var recorder = record.NewFakeRecorder(10)
+		server.recorder = recorder
+		// the pod created by the replica set inherit the annotation of the template
+		var pod = &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "nginx-test-", Namespace: "test1",
+				Annotations: map[string]string{utils.SkipAnnotation: "true"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-test-1",
+					UID: "replicaset-uid", Controller: pointer.BoolPtr(true)}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "docker.shijunlee.local/library/nginx:latest"}}},
+		}
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var review = newTestAdmissionReview(t, v1.Create)
+		review.Request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+		review.Request.Object.Raw = raw
+		if response := server.mutate(context.TODO(), review); len(response.Patch) != 0 {
+			t.Fatalf("expect no patch, got %s", string(response.Patch))
+		}
+		if len(recorder.Events) != 0 {
+			t.Fatalf("expect no event for the inherited annotation, got %s", <-recorder.Events)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		var server = newTestServer(t)
+		var recorder = record.NewFakeRecorder(10)
+		server.recorder = recorder
+		var review = newTestAdmissionReview(t, v1.Update)
+		setAnnotation(t, review, utils.RegistriesAnnotation, "docker.shijunlee.local")
+		review.Request.OldObject.Raw = review.Request.Object.Raw
+		// the scale update not change the annotations and the pod template
+		var object = &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(review.Request.Object.Raw); err != nil {
+			t.Fatal(err)
+		}
+		if err := unstructured.SetNestedField(object.Object, int64(3), "spec", "replicas"); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := object.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		review.Request.Object.Raw = raw
+		server.mutate(context.TODO(), review)
+		if len(recorder.Events) != 0 {
+			t.Fatalf("expect no event for the scale update, got %s", <-recorder.Events)
+		}
+		setAnnotation(t, review, utils.RegistriesAnnotation, "docker.shijunlee.local,quay.io")
+		server.mutate(context.TODO(), review)
+		if event := <-recorder.Events; !strings.Contains(event, utils.EventReasonRegistriesRequested) {
+			t.Fatalf("unexpected event %s", event)
+		}
+	})
+}
+
+func Test_MutateDeterministicPatch(t *testing.T) {
+	var server = newTestServer(t)
+	var secondSecret = newTestSourceSecret("tpaas-backup")
+	server.dockerSecretNames = []string{"tpaas-itg", "tpaas-backup"}
+	server.registryIndex = utils.NewRegistryIndex(zap.New(), server.dockerSecretNames)
+	server.registryIndex.Update(secondSecret)
+	if err := server.client.Create(context.TODO(), secondSecret); err != nil {
+		t.Fatal(err)
+	}
+	var source = &corev1.Secret{}
+	if err := server.client.Get(context.TODO(), types.NamespacedName{Namespace: "tool-test", Name: "tpaas-itg"}, source); err != nil {
+		t.Fatal(err)
+	}
+	server.registryIndex.Update(source)
+	server.secretOrder = utils.SecretOrder([]string{"tpaas-backup"}, server.dockerSecretNames)
+
+	var expect []byte
+	for i := 0; i < 20; i++ {
+		response := server.mutate(context.TODO(), newTestAdmissionReview(t, v1.Create))
+		if i == 0 {
+			expect = response.Patch
+			continue
+		}
+		if !bytes.Equal(expect, response.Patch) {
+			t.Fatalf("expect the same patch, got %s and %s", string(expect), string(response.Patch))
+		}
+	}
+	// the secret with priority is tried first by the kubelet
+	var backup, itg = strings.Index(string(expect), `"tpaas-backup"}`), strings.Index(string(expect), `"tpaas-itg"}`)
+	if backup < 0 || itg < 0 || backup > itg {
+		t.Fatalf("expect the secrets in priority order, got %s", string(expect))
+	}
+}
+
+func Test_MutatePodUpdate(t *testing.T) {
+	var server = newTestServer(t)
+	var newPod = func(image string, pullSecrets ...string) []byte {
+		var pod = &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "test1"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: image}}},
+		}
+		for _, item := range pullSecrets {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: item})
+		}
+		pod.Annotations = utils.SetManagedPullSecrets(nil, pullSecrets)
+		data, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	var review = &v1.AdmissionReview{
+		Request: &v1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Name:      "nginx",
+			Namespace: "test1",
+			Operation: v1.Update,
+			Object:    runtime.RawExtension{Raw: newPod("docker.shijunlee.local/library/nginx:1")},
+			OldObject: runtime.RawExtension{Raw: newPod("nginx:1")},
+		},
+	}
+	response := server.mutate(context.TODO(), review)
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Fatalf("expect no patch for the pod update, got %s", string(response.Patch))
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "tpaas-itg") {
+		t.Fatalf("expect the secret not added warning, got %v", response.Warnings)
+	}
+
+	// the managed secret the images not need any more is not pruned from the pod
+	review.Request.Object.Raw = newPod("nginx:2", "tpaas-itg")
+	review.Request.OldObject.Raw = newPod("nginx:1", "tpaas-itg")
+	if response = server.mutate(context.TODO(), review); len(response.Patch) != 0 {
+		t.Fatalf("expect no patch for the pod update, got %s", string(response.Patch))
+	}
+}
+
+func Test_MutateDeploymentUpdate(t *testing.T) {
+	var server = newTestServer(t)
+	var quaySecret = newTestSourceSecret("quay-secret")
+	quaySecret.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"quay.io":{"auth":"dGVzdDp0ZXN0"}}}`)
+	server.dockerSecretNames = []string{"tpaas-itg", "quay-secret"}
+	server.registryIndex = utils.NewRegistryIndex(zap.New(), server.dockerSecretNames)
+	server.registryIndex.Update(newTestSourceSecret("tpaas-itg"))
+	server.registryIndex.Update(quaySecret)
+	var newDeployment = func(images ...string) []byte {
+		var deployment = &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx-test", Namespace: "test1"},
+		}
+		var template = &deployment.Spec.Template
+		template.Annotations = utils.SetManagedPullSecrets(nil, []string{"tpaas-itg"})
+		// the user secret and the secret managed by the tool before
+		template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "user-secret"}, {Name: "tpaas-itg"}}
+		for index, image := range images {
+			template.Spec.Containers = append(template.Spec.Containers, corev1.Container{Name: fmt.Sprintf("c%d", index), Image: image})
+		}
+		data, err := json.Marshal(deployment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	var review = newTestAdmissionReview(t, v1.Update)
+	review.Request.Object.Raw = newDeployment("docker.shijunlee.local/library/nginx:latest", "quay.io/app/sidecar:v1")
+	review.Request.OldObject.Raw = newDeployment("docker.shijunlee.local/library/nginx:latest")
+	response := server.mutate(context.TODO(), review)
+	var expect = `[{"op":"replace","path":"/spec/template/metadata/annotations/secret-tools.io~1managed-pull-secrets","value":"quay-secret,tpaas-itg"},` +
+		`{"op":"add","path":"/spec/template/spec/imagePullSecrets/2","value":{"name":"quay-secret"}}]`
+	if string(response.Patch) != expect {
+		t.Fatalf("unexpected patch %s", string(response.Patch))
+	}
+}